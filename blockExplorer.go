@@ -1,6 +1,7 @@
 // [-b] 	Can pretty print blocks given a block id (1, 45, 89, etc)
 // [-s]		Stats
 // can view the blockId of blocks that contain transactions
+// can view a transaction given its transaction id
 // can view the blockId of blocks that contain pgp public keys
 // can view the number of coins in circulation
 // can view the block height
@@ -20,7 +21,8 @@ import (
 
 func main() {
 	blockchainFolderPtr := flag.String("f", "", "Folder that stores the blockchain to explore")
-	viewBlockPtr := flag.String("blk", "", "Block ID of a given block to view")
+	viewBlockPtr := flag.String("blk", "", "Block ID or block hash of a given block to view")
+	viewTransactionPtr := flag.String("tx", "", "Transaction ID of a given transaction to view")
 	blockHeightPtr := flag.Bool("h", false, "View the current block height")
 	coinCirculationPtr := flag.Bool("c", false, "View number of coins in circulation")
 	walletAddressListPtr := flag.Bool("w", false, "View all wallet addresses on the blockchain")
@@ -28,10 +30,12 @@ func main() {
 	publicKeyListPtr := flag.Bool("pub", false, "View all block IDs of blocks containing a PGP public key")
 	transactionBlocksPtr := flag.Bool("t", false, "View all block IDs of blocks that contain transactions")
 	walletBalancePtr := flag.Bool("b", false, "View the balance of all wallet addresses on the network")
+	paramsPtr := flag.String("params", blockchain.DefaultParamsFile, "Network parameters file")
 	flag.Parse()
 
 	blockchainFolder := *blockchainFolderPtr
 	viewBlockId := *viewBlockPtr
+	viewTransactionId := *viewTransactionPtr
 	blockHeightFlag := *blockHeightPtr
 	coinCirculationFlag := *coinCirculationPtr
 	walletAddressListFlag := *walletAddressListPtr
@@ -45,11 +49,25 @@ func main() {
 		return
 	}
 
-	blockchain.SetBlockchainFolder(blockchainFolder)
+	_, err := blockchain.LoadNetworkParams(*paramsPtr)
+	if err != nil {
+		fmt.Println("Unable to load network parameters:", err)
+		return
+	}
+
+	// the folder may belong to a running node so nothing is written to it
+	err = blockchain.OpenBlockchainReadOnly(blockchainFolder)
+	if err != nil {
+		fmt.Println("Unable to open blockchain:", err)
+		return
+	}
 
 	if viewBlockId != "" {
 		printBlock(viewBlockId)
 	}
+	if viewTransactionId != "" {
+		printTransaction(viewTransactionId)
+	}
 	if blockHeightFlag {
 		printBlockHeight()
 	}
@@ -74,20 +92,48 @@ func main() {
 }
 
 
+// blocks can be viewed by their block id or block hash
 func printBlock(blockID string) {
-	filename := "block_" + blockID + ".blk"
-	blockString, err := blockchain.LoadBlock(filename)
+	height, err := strconv.Atoi(blockID)
+	if err != nil {
+		var found bool
+		height, found = blockchain.HeightOfHash(blockID)
+		if !found {
+			fmt.Println("Block specified not available!")
+			return
+		}
+	}
+	blockString, err := blockchain.LoadBlock(height)
 	if err != nil {
 		fmt.Println("Block specified not available!")
 		return
 	}
 
-	fmt.Printf("\n%s\n", filename)
+	fmt.Printf("\nblock %d\n", height)
 	block := blockchain.DeserialiseBlock(blockString)
 	blockchain.PrettyPrint(block)
 }
 
 
+func printTransaction(txId string) {
+	location, found := blockchain.FindTransaction(txId)
+	if !found {
+		fmt.Println("Transaction specified not available!")
+		return
+	}
+	blockString, err := blockchain.LoadBlock(location.Height)
+	if err != nil {
+		fmt.Println("Transaction specified not available!")
+		return
+	}
+
+	confirmations := blockchain.Height() - location.Height + 1
+	fmt.Printf("\ntransaction %s in block %d, %d confirmations\n", txId, location.Height, confirmations)
+	block := blockchain.DeserialiseBlock(blockString)
+	blockchain.PrettyPrint(block.Body[location.Index])
+}
+
+
 func printBlockHeight() {
 	blockchainHeight := blockchain.Height()
 	fmt.Printf("\nBlockchain Height: %d\n", blockchainHeight)
@@ -95,8 +141,9 @@ func printBlockHeight() {
 
 
 func printNumOfCoins() {
-	height := blockchain.Height() + 1
-	fmt.Printf("\nNumber of coins in circulation: %d\n", (height * 10))
+	// the genesis allocations plus the reward of every mined block
+	minted := blockchain.GenesisAllocation() + int64(blockchain.Height()) * blockchain.BlockReward
+	fmt.Printf("\nNumber of coins in circulation: %s\n", coin.FormatAmount(minted))
 }
 
 
@@ -115,8 +162,7 @@ func getAllWalletAddresses() []string {
 	var allWallets []string
 
 	for i:=0; i <= height; i++ {
-		filename := "block_" + strconv.Itoa(i) + ".blk"
-		blockString, _ := blockchain.LoadBlock(filename)
+		blockString, _ := blockchain.LoadBlock(i)
 		block := blockchain.DeserialiseBlock(blockString)
 		allWallets = append(allWallets, extractWalletAddresses(block)...)
 	}
@@ -129,7 +175,7 @@ func extractWalletAddresses(block coin.Block) []string {
 	var addressList []string
 	for _, tx := range block.Body {
 		addressList = append(addressList, tx.ToAddress)
-		if tx.FromAddress != "coinbase" {
+		if !blockchain.IsCoinbase(tx) {
 			addressList = append(addressList, tx.FromAddress)
 		}
 	}
@@ -159,8 +205,7 @@ func printMinerStats() {
 	height := blockchain.Height()
 
 	for i:=0; i <= height; i++ {
-		filename := "block_" + strconv.Itoa(i) + ".blk"
-		blockString, _ := blockchain.LoadBlock(filename)
+		blockString, _ := blockchain.LoadBlock(i)
 		block := blockchain.DeserialiseBlock(blockString)
 		minerAddress := block.Body[0].ToAddress 
 		if minerExists[minerAddress] {
@@ -184,11 +229,10 @@ func printBlocksWithPublicKey() {
 	fmt.Println("\nBlocks containing PGP public keys:")
 
 	for i:=0; i <= height; i++ {
-		filename := "block_" + strconv.Itoa(i) + ".blk"
-		blockString, _ := blockchain.LoadBlock(filename)
+		blockString, _ := blockchain.LoadBlock(i)
 		block := blockchain.DeserialiseBlock(blockString)
 		if containsPublicKey(block) {
-			fmt.Printf("    %s\n", filename)
+			fmt.Printf("    block %d\n", i)
 		}
 	}
 }
@@ -211,12 +255,11 @@ func printBlocksWithTransactions() {
 	fmt.Println("  --\t\t  --")
 
 	for i:=0; i <= height; i++ {
-		filename := "block_" + strconv.Itoa(i) + ".blk"
-		blockString, _ := blockchain.LoadBlock(filename)
+		blockString, _ := blockchain.LoadBlock(i)
 		block := blockchain.DeserialiseBlock(blockString)
 		txBlock, txCount := containsTransactions(block)
 		if txBlock {
-			fmt.Printf("  %s\t  %d\n", filename, txCount)
+			fmt.Printf("  block %d\t  %d\n", i, txCount)
 		}
 	}
 }
@@ -235,28 +278,12 @@ func printAllWalletBalances() {
 	allWallets := getAllWalletAddresses()
 
 	for _, walletAddress := range allWallets {
-		fmt.Printf("  %s: %f\n", walletAddress, getWalletBalance(walletAddress))
+		fmt.Printf("  %s: %s\n", walletAddress, coin.FormatAmount(getWalletBalance(walletAddress)))
 	}
 
 }
 
 
-func getWalletBalance(wallet string) float64 {
-    networkHeight := blockchain.Height()
-    balance := 0.0
-
-    for i:=0; i <= networkHeight; i++ {
-        filename := "block_" + strconv.Itoa(i) + ".blk"
-        blockString, _ := blockchain.LoadBlock(filename)
-        block := blockchain.DeserialiseBlock(blockString)
-
-        for _, tx := range block.Body {
-            if tx.ToAddress == wallet {
-                balance += tx.Amount
-            } else  if tx.FromAddress == wallet {
-                balance -= tx.Amount
-            }
-        }
-    }
-    return balance
+func getWalletBalance(wallet string) int64 {
+    return blockchain.Balance(wallet)
 }
\ No newline at end of file
@@ -0,0 +1,258 @@
+// maintenance tool for blockchain folders
+// verify   checks every block in a folder, with -r it also removes the invalid blocks
+// rollback removes every block above a height and rebuilds the chain state and the node's public key cache
+// resync   rolls back (optional) then downloads the missing blocks from a node, moving onto the node's branch if the folder is on another one
+// diff     compares two blockchain folders and finds the first block where they diverge
+package main
+
+import (
+	"fmt"
+	"flag"
+	"os"
+
+	"pocketcoin/blockchain"
+	"pocketcoin/pgpcache"
+	"pocketcoin/netpack"
+)
+
+
+func usage() {
+	fmt.Println("Usage: go run chaintool.go <command> [arguments]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	fmt.Println("    verify   -f folder [-r]                       check every block, -r removes the invalid block and the blocks after it")
+	fmt.Println("    rollback -f folder -h height                  remove every block above the height and rebuild the public key cache")
+	fmt.Println("    resync   -f folder -p address [-h height]     roll back to the height (if given) then sync the missing blocks from a node")
+	fmt.Println("    diff     folder1 folder2                      find the first block where two blockchain folders diverge")
+	fmt.Println("")
+	fmt.Println("verify, rollback and resync take [-params file] to use a network parameters file other than " + blockchain.DefaultParamsFile)
+}
+
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		return
+	}
+
+	command := os.Args[1]
+	args := os.Args[2:]
+
+	switch command {
+	case "verify":
+		verifyCommand(args)
+	case "rollback":
+		rollbackCommand(args)
+	case "resync":
+		resyncCommand(args)
+	case "diff":
+		diffCommand(args)
+	default:
+		usage()
+	}
+}
+
+
+func openBlockchain(folder string, paramsFile string) bool {
+	if folder == "" {
+		fmt.Println("Missing command line argument [-f] - folder that stores the blockchain")
+		return false
+	}
+
+	params, err := blockchain.LoadNetworkParams(paramsFile)
+	if err != nil {
+		fmt.Println("Unable to load network parameters:", err)
+		return false
+	}
+	netpack.SetLocalVersion(params.GenesisHash, "pocketcoin-chaintool", 0, blockchain.Height)
+
+	err = blockchain.SetBlockchainFolder(folder)
+	if err == nil {
+		err = blockchain.InitGenesis()
+	}
+	if err != nil {
+		fmt.Println("Unable to open blockchain:", err)
+		return false
+	}
+	return true
+}
+
+
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	folderPtr := flags.String("f", "", "folder that stores the blockchain")
+	repairPtr := flags.Bool("r", false, "remove the invalid block and every block after it")
+	paramsPtr := flags.String("params", blockchain.DefaultParamsFile, "network parameters file")
+	flags.Parse(args)
+
+	if !openBlockchain(*folderPtr, *paramsPtr) {
+		return
+	}
+
+	fmt.Printf("Checking %d blocks...\n", blockchain.Height() + 1)
+	valid, invalidBlock, invalidReason := blockchain.IsValid()
+	if valid {
+		fmt.Println("Blockchain valid")
+		return
+	}
+
+	fmt.Printf("Blockchain found invalid on block %d\n", invalidBlock)
+	fmt.Println("Reason block is invalid:", invalidReason)
+	if !*repairPtr {
+		fmt.Println("Run again with -r to remove the invalid blocks")
+		return
+	}
+
+	rollback(invalidBlock - 1)
+}
+
+
+func rollbackCommand(args []string) {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	folderPtr := flags.String("f", "", "folder that stores the blockchain")
+	heightPtr := flags.Int("h", -1, "height to roll back to")
+	paramsPtr := flags.String("params", blockchain.DefaultParamsFile, "network parameters file")
+	flags.Parse(args)
+
+	if !openBlockchain(*folderPtr, *paramsPtr) {
+		return
+	}
+	if *heightPtr < 0 {
+		fmt.Println("Missing command line argument [-h] - height to roll back to")
+		return
+	}
+
+	rollback(*heightPtr)
+}
+
+
+// removes the blocks above the height then rebuilds the chain state
+func rollback(height int) bool {
+	if height >= blockchain.Height() {
+		fmt.Printf("Blockchain height is %d, nothing to remove\n", blockchain.Height())
+		return true
+	}
+
+	removed := blockchain.Height() - height
+	err := blockchain.Rollback(height)
+	if err != nil {
+		fmt.Println("Unable to roll back blockchain:", err)
+		return false
+	}
+	blockchain.LoadChainState()
+	rebuildPgpCache()
+
+	fmt.Printf("Removed %d blocks, blockchain height is now %d\n", removed, blockchain.Height())
+	return true
+}
+
+
+// rebuilds the node's public key cache (relative to the folder chaintool is run from) from the remaining blocks,
+// keys that were only in the removed blocks would otherwise let wallets leave out a key that's no longer on the blockchain
+func rebuildPgpCache() {
+	if _, err := os.Stat(pgpcache.DefaultFilename); os.IsNotExist(err) {
+		return
+	}
+
+	cache := pgpcache.Load(pgpcache.DefaultFilename)
+	err := cache.Rebuild()
+	if err != nil {
+		fmt.Println("Unable to rebuild the public key cache, the node rebuilds it when it starts:", err)
+		return
+	}
+	fmt.Printf("Rebuilt %s with %d public keys\n", pgpcache.DefaultFilename, cache.Len())
+}
+
+
+func resyncCommand(args []string) {
+	flags := flag.NewFlagSet("resync", flag.ExitOnError)
+	folderPtr := flags.String("f", "", "folder that stores the blockchain")
+	addressPtr := flags.String("p", "", "host:port address of the node to sync from, a bare port is on localhost")
+	heightPtr := flags.Int("h", -1, "height to roll back to before syncing")
+	paramsPtr := flags.String("params", blockchain.DefaultParamsFile, "network parameters file")
+	flags.Parse(args)
+
+	if !openBlockchain(*folderPtr, *paramsPtr) {
+		return
+	}
+	if *addressPtr == "" {
+		fmt.Println("Missing command line argument [-p] - address of the node to sync from")
+		return
+	}
+
+	if *heightPtr >= 0 && !rollback(*heightPtr) {
+		return
+	}
+
+	blockchain.LoadBlockIndex()
+	blockchain.LoadChainState()
+
+	// heights alone miss a node on another branch of the same height, so find where its chain leaves ours
+	forkHeight, diverged, err := blockchain.ForkPoint(*addressPtr)
+	if err != nil {
+		fmt.Println("Unable to get the node's headers:", err)
+		return
+	}
+	if !diverged {
+		fmt.Printf("The node has no blocks the local blockchain doesn't, height %d\n", blockchain.Height())
+		return
+	}
+
+	// resync follows the node, so local blocks on another branch are removed even if that branch has more work
+	if forkHeight < blockchain.Height() {
+		fmt.Printf("The node is on a different branch after block %d\n", forkHeight)
+		if !rollback(forkHeight) {
+			return
+		}
+		blockchain.LoadBlockIndex()
+	}
+
+	fmt.Printf("Syncing from %s...\n", *addressPtr)
+	_, err = blockchain.SyncBlockchain([]string{*addressPtr})
+	if err != nil {
+		fmt.Println("Unable to sync blockchain:", err)
+		return
+	}
+	fmt.Println("Blockchain synced! Height:", blockchain.Height())
+}
+
+
+func diffCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("diff needs two blockchain folders")
+		return
+	}
+
+	// opened read only so diff can be run on the folders of running nodes
+	stores := make([]blockchain.BlockStore, 2)
+	for i, folder := range args {
+		store, err := blockchain.OpenBlockStoreReadOnly(folder)
+		if err != nil {
+			fmt.Printf("Unable to open %s: %s\n", folder, err)
+			return
+		}
+		defer store.Close()
+		stores[i] = store
+	}
+
+	heights := []int{stores[0].Height(), stores[1].Height()}
+	fmt.Printf("%s height: %d\n", args[0], heights[0])
+	fmt.Printf("%s height: %d\n", args[1], heights[1])
+
+	for height := 0; height <= heights[0] && height <= heights[1]; height++ {
+		hash1, _ := stores[0].BlockHash(height)
+		hash2, _ := stores[1].BlockHash(height)
+		if hash1 != hash2 {
+			fmt.Printf("\nBlockchains diverge at block %d\n", height)
+			fmt.Printf("    %s: %s\n", args[0], hash1)
+			fmt.Printf("    %s: %s\n", args[1], hash2)
+			return
+		}
+	}
+
+	if heights[0] == heights[1] {
+		fmt.Println("\nBlockchains are identical")
+	} else {
+		fmt.Println("\nBlockchains match up to the shorter blockchain's height")
+	}
+}
@@ -0,0 +1,94 @@
+// creates the genesis block of a network from its network parameters file
+// the nonce and hash of the genesis block are written back into the parameters file
+// then each blockchain folder is started with the genesis block
+package main
+
+import (
+	"fmt"
+	"flag"
+	"os"
+	"runtime"
+	"strings"
+
+	"pocketcoin/blockchain"
+	"pocketcoin/fileutil"
+	"pocketcoin/mining"
+)
+
+
+func main() {
+	paramsPtr := flag.String("params", blockchain.DefaultParamsFile, "network parameters file")
+	foldersPtr := flag.String("f", "", "comma separated blockchain folders to start with the genesis block")
+	resetPtr := flag.Bool("reset", false, "remove every block from folders that have a different genesis block")
+	flag.Parse()
+
+	params, err := blockchain.ReadNetworkParams(*paramsPtr)
+	if err != nil {
+		fmt.Println("Unable to read network parameters:", err)
+		return
+	}
+
+	// mine the genesis block, the nonce is kept if the parameters haven't changed since it was mined
+	genesis := blockchain.GenesisBlock(params)
+	if genesis.Hash != params.GenesisHash || !blockchain.HashMeetsTarget(genesis.Hash, genesis.Header.TargetBits) {
+		fmt.Printf("Mining the %s genesis block...\n", params.NetworkName)
+		prefix, suffix := blockchain.HeaderTemplate(genesis.Header)
+		template := mining.Template{Prefix: prefix, Suffix: suffix}
+		var stop int32
+		result := mining.Mine(template, blockchain.CompactToBig(genesis.Header.TargetBits), runtime.NumCPU(), &stop, nil)
+
+		params.GenesisNonce = result.Nonce
+		params.GenesisHash = result.Hash
+		err = blockchain.SaveNetworkParams(*paramsPtr, params)
+		if err != nil {
+			fmt.Println("Unable to save network parameters:", err)
+			return
+		}
+	}
+
+	params, err = blockchain.LoadNetworkParams(*paramsPtr)
+	if err != nil {
+		fmt.Println("Unable to load network parameters:", err)
+		return
+	}
+	fmt.Println("Genesis block hash:", params.GenesisHash)
+
+	if *foldersPtr == "" {
+		return
+	}
+	genesisString, _ := blockchain.Serialise(blockchain.GenesisBlock(params))
+	for _, folder := range strings.Split(*foldersPtr, ",") {
+		initFolder(strings.TrimSpace(folder), genesisString, *resetPtr)
+	}
+}
+
+
+// writes the genesis block file, used when the folder is opened for the first time, and adds the genesis block to the folders blockchain
+func initFolder(folder string, genesisString string, reset bool) {
+	err := os.MkdirAll(folder, 0755)
+	if err == nil {
+		err = fileutil.AtomicWriteFile(folder + "/block_0.blk", []byte(genesisString), 0644)
+	}
+	if err == nil {
+		err = blockchain.SetBlockchainFolder(folder)
+	}
+	if err != nil {
+		fmt.Printf("%s: %s\n", folder, err)
+		return
+	}
+
+	err = blockchain.InitGenesis()
+	if err != nil && reset {
+		fmt.Printf("%s: %s, removing every block\n", folder, err)
+		err = blockchain.Rollback(-1)
+		if err == nil {
+			err = blockchain.InitGenesis()
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s: %s, run again with -reset to remove its blocks\n", folder, err)
+		return
+	}
+
+	fmt.Printf("%s: blockchain height %d\n", folder, blockchain.Height())
+}
@@ -5,14 +5,15 @@ import (
 	"pocketcoin/coin"
 	"pocketcoin/blockchain"
 	"pocketcoin/netpack"
-	"math"
+	"pocketcoin/mempool"
+	"pocketcoin/mining"
 	"math/big"
+	"runtime"
+	"sync/atomic"
 	"time"
 	"strconv"
 	"strings"
 	"net"
-	"bufio"
-	"encoding/json"
 	"flag"
 )
 
@@ -27,12 +28,12 @@ const (
 )
 
 
-var continueFlag = true
-var transactionPool []coin.Transaction
-var power = 231 // 233 = 2m12  |  231 = 4m39
-var target = math.Pow(2, float64(power))
+const invalidBlockScore = 20  // ban score added to a peer for each invalid block it sends
+
+var stopMining int32 // set to 1 to stop mining the current block
+var miningWorkers = runtime.NumCPU()
+var txPool = mempool.New(mempool.DefaultMaxSize, mempool.DefaultExpiry)
 
-var nodeList = []string{"5555", "5556", "5557", "5558", "5559"}
 
 
 func check(err error) {
@@ -45,13 +46,17 @@ func check(err error) {
 func main() {
 
 	argPortPtr := flag.String("p", "2222", "port to run the miner on")
+	argHostPtr := flag.String("host", CONN_ADDR, "host name or ip address that the miner listens on, given to peers to connect back")
 	argWalletAddrPtr := flag.String("w", "", "miner's wallet address")
 	argBlockchainFolderPtr := flag.String("f", "", "folder that stores the miners blockchain")
+	argWorkersPtr := flag.Int("t", runtime.NumCPU(), "number of mining threads")
+	argParamsPtr := flag.String("params", blockchain.DefaultParamsFile, "network parameters file")
 	flag.Parse()
 
 	connPort := *argPortPtr
 	walletAddress := *argWalletAddrPtr
 	blockchainFolder := *argBlockchainFolderPtr
+	miningWorkers = *argWorkersPtr
 
 	if walletAddress == "" {
 		fmt.Println("Missing command line argument [-w] - miner's wallet address")
@@ -62,7 +67,30 @@ func main() {
 		return
 	}
 
-	blockchain.SetBlockchainFolder(blockchainFolder)
+	params, err := blockchain.LoadNetworkParams(*argParamsPtr)
+	if err != nil {
+		fmt.Println("Unable to load network parameters:", err)
+		return
+	}
+
+	err = blockchain.SetBlockchainFolder(blockchainFolder)
+	if err == nil {
+		err = blockchain.InitGenesis()
+	}
+	if err != nil {
+		fmt.Println("Unable to open blockchain:", err)
+		return
+	}
+	listenAddress := *argHostPtr + ":" + connPort
+	netpack.SetListenAddress(listenAddress)
+	netpack.SetLocalVersion(params.GenesisHash, "pocketcoin-miner", netpack.ServiceMining, blockchain.Height)
+
+	// learn about more nodes from the ones already known
+	netpack.LoadPeers(blockchainFolder + "/peers.json", params.SeedNodes, params.SeedMiners)
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		netpack.RequestPeers(address, "miner")
+	}
+	netpack.SavePeers()
 
 	// check that the locally stored blockchain is valid
 	fmt.Println("Checking blockchain...")
@@ -72,31 +100,42 @@ func main() {
     } else {
         fmt.Printf("Blockchain found invalid on block %d\n", invalidBlock)
         fmt.Println("Reason block is invalid:", invalidReason)
-        fmt.Println("Please repair blockchain\nExiting...")
-        return
+        fmt.Println("Repairing blockchain...")
+        err := blockchain.Repair(invalidBlock)
+        if err != nil {
+            fmt.Println("Unable to repair blockchain:", err)
+            return
+        }
+        fmt.Printf("Blocks from %d onwards removed, blockchain height is now %d\n", invalidBlock, blockchain.Height())
     }
 
+	blockchain.LoadBlockIndex()
+	blockchain.LoadChainState()
+
 	// check if the blockchain height matches the networks, if not then sync the blockchain
 	localBlockHeight := blockchain.Height()
-	bestNode, networkBlockHeight := getHighestNodeBlockHeight()
+	_, networkBlockHeight := blockchain.GetHighestNodeBlockHeight(netpack.Peers(netpack.NodePeer))
 	if localBlockHeight != networkBlockHeight && networkBlockHeight != 0 {
 		fmt.Println("\nBlockchain out of sync!")
 		fmt.Printf("Local block height: %d  |  Network block height: %d\n", localBlockHeight, networkBlockHeight)
-		heightDiff := (networkBlockHeight - localBlockHeight)
-		fmt.Printf("Number of missing blocks: %d\n", heightDiff)
 		fmt.Println("Syncing blockchain...")
-		success := syncBlockchain(localBlockHeight, heightDiff, bestNode)
-		if success {
-			fmt.Println("Blockchain synced!\n")	
+		_, err := blockchain.SyncBlockchain(netpack.Peers(netpack.NodePeer))
+		if err != nil {
+			fmt.Println("Unable to sync blockchain, trying again in the background:", err)
 		} else {
-			return
+			fmt.Println("Blockchain synced! Height:", blockchain.Height())
 		}
-		
 	}
 
+	// keep checking for blocks missed while offline or on another branch
+	nodePeers := func() []string {
+		return netpack.Peers(netpack.NodePeer)
+	}
+	go blockchain.KeepSynced(nodePeers, applyChainUpdate)
+
 	go mineBlocks(walletAddress)
 
-	ln, err := net.Listen(CONN_TYPE, CONN_ADDR + ":" + connPort)
+	ln, err := net.Listen(CONN_TYPE, listenAddress)
 	check(err)
 	for {
 		conn, err := ln.Accept()
@@ -112,37 +151,29 @@ func mineBlocks(walletAddress string) {
 		currentBlockHeight := blockchain.Height()
 		blockId := strconv.Itoa(currentBlockHeight + 1)
 
+		// get prev block
+		prevBlock := blockchain.GetHighestBlock()
+		prevHeaderHash := prevBlock.Hash
+
 		// build transaction body
-		coinbase := constructCoinbaseTransaction(walletAddress)
-		transactionBody := constructTransactionBody(coinbase)
+		transactionBody := constructTransactionBody(walletAddress, prevBlock)
 
 		// generate merkle root
-		transactionBodyString, _ := blockchain.Serialise(transactionBody)
-		merkleRoot := blockchain.SHA256([]byte(transactionBodyString))
-
-		// get prev block hash
-		prevBlock := blockchain.GetHighestBlock()
-		prevHeaderHash := prevBlock.Hash
+		merkleRoot := getMerkleRoot(transactionBody)
 
 		// construct block header
-		blockHeader := constructBlockHeader(prevHeaderHash, blockId, merkleRoot)
+		target := blockchain.NextTarget(prevBlock)
+		blockHeader := constructBlockHeader(prevHeaderHash, blockId, merkleRoot, target)
 
 		// mine block
 		printStats(currentBlockHeight, len(transactionBody))
 		fmt.Println("Mining Block...")
 		start := time.Now()
-		blockHash, blockTerminated := findHash(&blockHeader, target)
+		blockHash, blockTerminated := findHash(&blockHeader, blockchain.CompactToBig(target))
 		fmt.Println("Hash time:", time.Since(start))
 
-		// condition if another miner found the block
+		// condition if another miner found the block, its transactions were removed from the pool when it was added
 		if blockTerminated {
-			newBlockHeight := blockchain.Height()
-			newBlockFilename := "block_" + strconv.Itoa(newBlockHeight) + ".blk"
-			newestBlockString, _ := blockchain.LoadBlock(newBlockFilename)
-			newestBlock := blockchain.DeserialiseBlock(newestBlockString)
-
-			refilTransactionPool(transactionBody[1:], newestBlock.Body)
-
 			continue
 		}
 
@@ -150,99 +181,216 @@ func mineBlocks(walletAddress string) {
 		block := constructBlock(blockHash, blockHeader, transactionBody)
 		blockchain.PrettyPrint(block)
 
-		// check validity of the new block
-		blockValid, invalidReason := blockchain.VerifyBlock(block, prevBlock)
-		if blockValid{
-			// update blockchain
-			serialisedBlock, _ := blockchain.Serialise(block)
-			blockchain.Update(serialisedBlock, blockId)
-			broadcastMinedBlock(block)
-		} else {
+		// check validity of the new block and update blockchain
+		// a rejected block is dropped and the next one is built on whatever the tip is now
+		update, blockValid, invalidReason := blockchain.ProcessBlock(block)
+		if !blockValid {
 			fmt.Println("Block Invalid:", invalidReason)
-			break
+			continue
 		}
+		updateTransactionPool(update)
+		broadcastMinedBlock(block)
 	}
 }
 
 
-func findHash(blockHeader *coin.BlockHeader, target float64) (string, bool) {
-	nonce := 0
-	blockHashString := ""
-	b := big.NewFloat(target)
-	terminated := false
-
-	for continueFlag {
-		blockHeader.Nonce = nonce
-		hashString, _ := blockchain.Serialise(blockHeader)
-
-		targetHashString := blockchain.SHA256([]byte(hashString))
-		blockHashString = blockchain.SHA256([]byte(targetHashString))
-
-		hashInt, _ := new(big.Int).SetString(blockHashString, 16)
-
-		a := new(big.Float).SetInt(hashInt)
-		
-		if a.Cmp(b) == -1 {
-			fmt.Printf("Block hash found after %d hashes\n", nonce)
-			fmt.Println("Block hash:", blockHashString)
-			break
-		}
-		nonce += 1
+func findHash(blockHeader *coin.BlockHeader, target *big.Int) (string, bool) {
+	prefix, suffix := blockchain.HeaderTemplate(*blockHeader)
+	template := mining.Template{Prefix: prefix, Suffix: suffix}
+	reportHashRate := func(hashRate float64) {
+		fmt.Println("Hash rate:", mining.FormatHashRate(hashRate))
 	}
 
-	if continueFlag == false {
+	result := mining.Mine(template, target, miningWorkers, &stopMining, reportHashRate)
+	fmt.Printf("%d hashes at %s using %d workers\n", result.Hashes, mining.FormatHashRate(result.HashRate()), miningWorkers)
+
+	if !result.Found {
 		fmt.Println("Mining stopped due to flag set")
-		terminated = true
-		continueFlag = true
+		atomic.StoreInt32(&stopMining, 0)
+		return "", true
 	}
 
-	return blockHashString, terminated
+	blockHeader.Nonce = result.Nonce
+	fmt.Println("Block hash found with nonce", result.Nonce)
+	fmt.Println("Block hash:", result.Hash)
+
+	return result.Hash, false
 }
 
 
 func handleConnection(conn net.Conn) {
-	rawPacket, _ := bufio.NewReader(conn).ReadString('\n')
+	peer, err := netpack.Accept(conn)
+	if err != nil {
+		fmt.Println("Handshake failed:", err)
+		return
+	}
+	defer peer.Close()
+	netpack.PeerSeen(peer.Address, netpack.PeerType(peer.Version.Services))
+
+	// the connection stays open for more packets until the peer closes it or it's idle for too long
+	for {
+		packet, err := peer.ReadPacket()
+		if err != nil {
+			return
+		}
+		handlePacket(peer, packet)
+	}
+}
 
-	packet := coin.NetworkPacket{}
-	json.Unmarshal([]byte(rawPacket ), &packet)
 
+func handlePacket(peer *netpack.Conn, packet coin.NetworkPacket) {
 	packetHeader := packet.Header
 
 	if packetHeader.Request == "MinedBlock" {
-		handleNewMinedBlock(packet)
+		handleNewMinedBlock(packet, peer)
 	} else if packetHeader.Request == "Transaction" {
 		handleNewTransaction(packet)
+	} else if packetHeader.Request == "GetBlockByHash" {
+		peer.Send(handleGetBlockByHash(packet.Body))
+	} else if packetHeader.Request == "GetPeers" {
+		peer.Send(netpack.PeersPacket("miner"))
+	} else if packetHeader.Request == "Peers" {
+		netpack.AddPeerAddresses(packet.Body)
+	} else if packetHeader.Request == "Inv" {
+		netpack.RequestInventory("miner", peer, packet.Body, haveInventory)
 	}
-
 }
 
 
-func handleNewMinedBlock(packet coin.NetworkPacket) {
-	newBlockString := packet.Body
-	newBlock := blockchain.DeserialiseBlock(newBlockString)
-	prevBlock := blockchain.GetHighestBlock()
+// peer is the connection the block arrived on, invalid blocks add to its ban score
+func handleNewMinedBlock(packet coin.NetworkPacket, peer *netpack.Conn) {
+	newBlock := blockchain.DeserialiseBlock(packet.Body)
+	if processPeerBlock(newBlock, peer) == blockchain.OrphanBlockReason {
+		requestMissingBlocks(blockchain.OrphanRoot(newBlock.Hash), peer)
+		blockchain.RequestSync()
+	}
+}
+
 
-	blockValid, invalidReason := blockchain.VerifyBlock(newBlock, prevBlock)
-	if blockValid {
+// adds a block from a peer to the blockchain, returns the reason ProcessBlock gave
+func processPeerBlock(newBlock coin.Block, peer *netpack.Conn) string {
+	update, blockValid, invalidReason := blockchain.ProcessBlock(newBlock)
+	if invalidReason == blockchain.OrphanBlockReason {
+		fmt.Println("**Orphan block received, requesting previous block")
+	} else if blockValid {
 		fmt.Println("**New block valid!")
-		continueFlag = false
-		blockId := blockchain.Height() + 1
-		_ = blockchain.Update(newBlockString, strconv.Itoa(blockId))
+		if len(update.Connected) == 0 {
+			fmt.Println("**Block added to a side branch")
+		} else {
+			applyChainUpdate(update)
+		}
 	} else {
 		fmt.Println("**New block found not valid!")
 		fmt.Println("**Reason:", invalidReason)
+		if invalidReason != blockchain.KnownBlockReason {
+			peer.Misbehaving(invalidBlockScore, invalidReason)
+		}
+	}
+	return invalidReason
+}
+
+
+// stops mining the current block once the main chain changes
+func applyChainUpdate(update blockchain.ChainUpdate) {
+	updateTransactionPool(update)
+	atomic.StoreInt32(&stopMining, 1)
+}
+
+
+// removes the transactions mined in the connected blocks from the pool
+// transactions in blocks removed from the main chain need mining again
+func updateTransactionPool(update blockchain.ChainUpdate) {
+	for _, block := range update.Connected {
+		txPool.RemoveBlock(block)
+	}
+
+	// checked against the new tip, oldest block first so a sender's transactions go back in nonce order
+	for i := len(update.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range update.Disconnected[i].Body[1:] {
+			if valid, _ := transactionValid(tx); valid {
+				txPool.Add(tx)
+			}
+		}
+	}
+}
+
+
+// fetches the missing parents of an orphan block from the peer that sent the orphan, at the address verified
+// for its connection, if there isn't one the background sync fetches the missing blocks instead
+// each parent can be another orphan so they're fetched in a loop, capped so a peer that keeps
+// answering with new parents can't keep the miner fetching forever
+func requestMissingBlocks(blockHash string, peer *netpack.Conn) {
+	address := peer.Address
+	if address == "" {
+		return
+	}
+
+	for i := 0; i < blockchain.MaxOrphanBlocks; i++ {
+		reqHeader := netpack.ConstructRequestHeader("miner", "GetBlockByHash")
+		packet := netpack.ConstructNetworkPacket(reqHeader, blockHash)
+		packetString, _ := blockchain.Serialise(packet)
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
+		if !success || response.Body == "" {
+			return
+		}
+
+		block := blockchain.DeserialiseBlock(response.Body)
+		if block.Hash != blockHash || processPeerBlock(block, peer) != blockchain.OrphanBlockReason {
+			return
+		}
+		blockHash = blockchain.OrphanRoot(block.Hash)
 	}
 }
 
 
+// returns whether the miner already has an item a node announced
+func haveInventory(item coin.InvItem) bool {
+	if item.Type == netpack.InvBlock {
+		return blockchain.BlockKnown(item.Hash)
+	}
+	return txPool.Has(item.Hash)
+}
+
+
+func handleGetBlockByHash(blockHash string) string {
+	blockString := ""
+	block, found := blockchain.GetBlockByHash(blockHash)
+	if found {
+		blockString, _ = blockchain.Serialise(block)
+	}
+
+	respHeader := netpack.ConstructRequestHeader("miner", "GetBlockByHash")
+	respPacket := netpack.ConstructNetworkPacket(respHeader, blockString)
+	packetString, _ := blockchain.Serialise(respPacket)
+
+	return packetString
+}
+
+
 func handleNewTransaction(packet coin.NetworkPacket) {
 	newTxString := packet.Body
 	newTx := blockchain.DeserialiseTransaction(newTxString)
 
-	if !transactionInList(newTx, transactionPool) {
-		transactionPool = append(transactionPool, newTx)
+	if valid, invalidReason := transactionValid(newTx); !valid {
+		fmt.Println("**Transaction invalid. Reason:", invalidReason)
+		return
 	}
+	txPool.Add(newTx)
+}
 
+
+// checks a transaction against the chain state at the highest block with the senders pending transactions applied
+// the pool only takes checked transactions, so an unsigned one can't take the nonce of the senders real transaction
+func transactionValid(tx coin.Transaction) (bool, string) {
+	state, found := blockchain.ChainStateAt(blockchain.GetHighestBlock())
+	if !found {
+		return false, "Chain state unavailable"
+	}
+
+	for _, pending := range txPool.BySender(tx.FromAddress) {
+		state.ConnectTransaction(pending)
+	}
+	return state.ValidTransaction(tx)
 }
 
 
@@ -250,68 +398,64 @@ func printStats(currentBlockHeight int, numTxInBlock int) {
 	fmt.Print("\n")
 	fmt.Println(strings.Repeat("#", 50))
 	fmt.Printf("Current Block Height: %d\n", currentBlockHeight)
-	fmt.Printf("Number of transactions in pool: %d\n", len(transactionPool))
+	fmt.Printf("Number of transactions in pool: %d\n", txPool.Count())
 	fmt.Printf("Number of transactions in current block: %d\n", numTxInBlock)
 }
 
 
-func constructBlockHeader(prev_block_hash string, blockId string, merkleRoot string) coin.BlockHeader{
+func constructBlockHeader(prev_block_hash string, blockId string, merkleRoot string, target uint32) coin.BlockHeader{
 	bHeader := BH{}
 
-	bHeader.Version = 0.1
+	bHeader.Version = blockchain.BlockVersion
 	bHeader.BlockId = blockId
 	bHeader.PrevBlockHash = prev_block_hash
 	bHeader.MerkleRoot = merkleRoot
-	bHeader.Timestamp = time.Now().String()
+	bHeader.Timestamp = time.Now().Round(0).String()
 	bHeader.TargetBits = target
 
 	return bHeader
 }
 
 
-func constructTransactionBody(coinbaseTransaction coin.Transaction) []coin.Transaction {
-	txBody := []TX{}
-	txBody = append(txBody, coinbaseTransaction)
-	var tx coin.Transaction
-
-	lim := len(transactionPool)
-	for i := 0; i < lim; i++ {
-		if i >= 10 {
-			break
+// takes the transactions paying the highest fee per byte from the pool, the coinbase claims the reward plus their fees
+// transactions that aren't valid on top of the previous block are left in the pool
+func constructTransactionBody(walletAddress string, prevBlock coin.Block) []coin.Transaction {
+	// a sender's transactions have to be added in nonce order, so keep passing over the pool
+	// until no more transactions can be added in case a higher fee one was waiting on a lower nonce
+	// the transactions stay in the pool until the block is added to the blockchain
+	state, _ := blockchain.ChainStateAt(prevBlock)
+	remainingTxs := txPool.ByFeeRate()
+	selectedTxs := []TX{}
+	for added := true; added; {
+		added = false
+		var skippedTxs []TX
+		for _, tx := range remainingTxs {
+			if len(selectedTxs) < blockchain.MaxBlockTransactions {
+				if valid, _ := state.ConnectTransaction(tx); valid {
+					selectedTxs = append(selectedTxs, tx)
+					added = true
+					continue
+				}
+			}
+			skippedTxs = append(skippedTxs, tx)
 		}
-		tx, transactionPool = transactionPool[0], transactionPool[1:]
-		txBody = append(txBody, tx)
+		remainingTxs = skippedTxs
 	}
 
-	return txBody
-}
-
-
-func refilTransactionPool(transactions []coin.Transaction, txList []coin.Transaction) {
-	for _, tx := range transactions {
-		if transactionInList(tx, txList) {
-			continue
-		}
-		transactionPool = append([]coin.Transaction{tx}, transactionPool...)
-	}
-}
-
+	coinbase := constructCoinbaseTransaction(walletAddress, blockchain.TotalFees(selectedTxs))
+	txBody := []TX{}
+	txBody = append(txBody, coinbase)
+	txBody = append(txBody, selectedTxs...)
 
-func transactionInList(tx coin.Transaction, blockBody []coin.Transaction) bool {
-	for _, blockTx := range blockBody {
-		if tx == blockTx {
-			return true
-		}
-	}
-	return false
+	return txBody
 }
 
 
-func constructCoinbaseTransaction(walletAddress string) coin.Transaction {
+func constructCoinbaseTransaction(walletAddress string, fees int64) coin.Transaction {
  	coinbase := TX{}
- 	coinbase.Amount = 10.0
+ 	coinbase.Amount = blockchain.BlockReward + fees
  	coinbase.ToAddress = walletAddress
- 	coinbase.FromAddress = "coinbase"
+ 	coinbase.FromAddress = blockchain.CoinbaseAddress
  	coinbase.Signature = ""
  	coinbase.PublicKey = ""
  	coinbase.Timestamp = time.Now().String()
@@ -321,18 +465,7 @@ func constructCoinbaseTransaction(walletAddress string) coin.Transaction {
 
 
 func getMerkleRoot(transactions []coin.Transaction) string {
-	transactionBodyString, _ := blockchain.Serialise(transactions)
-	transactionBodyHash := blockchain.SHA256([]byte(transactionBodyString))
-
-	return transactionBodyHash
-}
-
-
-func hashPrevBlockHeader(prevBlock coin.Block) string {
-	prevHeaderString, _ := blockchain.Serialise(prevBlock.Header)
-	prevHeaderHash := blockchain.SHA256([]byte(prevHeaderString))
-
-	return prevHeaderHash
+	return blockchain.MerkleRoot(transactions)
 }
 
 
@@ -353,97 +486,10 @@ func broadcastMinedBlock(block coin.Block) {
 	reqHeader := netpack.ConstructRequestHeader("miner", "MinedBlock")
 	packet := netpack.ConstructNetworkPacket(reqHeader, blockString)
 
-	for _, addr := range nodeList {
+	for _, addr := range netpack.Peers(netpack.NodePeer) {
 		packetString, _ := blockchain.Serialise(packet)
 		netpack.BroadcastPacket(packetString, addr)
+		netpack.MarkKnown(addr, block.Hash)
 	}
 
 }
-
-
-func addToTransactionPool(tx coin.Transaction) {
-	transactionPool = append(transactionPool, tx)
-}
-
-
-func getHighestNodeBlockHeight() (string, int) {
-	highest := 0
-	bestNode := ""
-
-	for _, port := range nodeList {
-		height := getNetworkBlockHeight(port)
-		if height >  highest {
-			highest = height
-			bestNode = port
-		}
-	}
-
-	return bestNode, highest
-}
-
-
-func getNetworkBlockHeight(port string) int {
-	reqHeader := netpack.ConstructRequestHeader("miner", "BlockHeight")
-	packet := netpack.ConstructNetworkPacket(reqHeader, "")
-	packetString, _ := blockchain.Serialise(packet)
-	success, response := netpack.BroadcastDuplexPacket(packetString, port)
-
-	if success {
-		networkHeight, _ := strconv.Atoi(response.Body)
-		return networkHeight
-	} else {
-		return -1
-	}
-}
-
-
-func syncBlockchain(blockHeight int, heightDiff int, port string) bool {
-	prevBlock := blockchain.GetHighestBlock()
-
-	// establish connection with node
-	conn, err := net.Dial("tcp", "localhost:"+port)
-	if err != nil {
-		fmt.Println("Unable to establish a connection with the specified node")
-		return false
-	}
-
-	// create blockchain sync initialisation packet
-	reqHeader := netpack.ConstructRequestHeader("miner", "SyncBlockchain")
-	packet := netpack.ConstructNetworkPacket(reqHeader, strconv.Itoa(blockHeight))
-	packetString, _ := blockchain.Serialise(packet)
-
-	// send blockchain sync initialisation request
-	fmt.Fprintf(conn, packetString + "\n")
-
-	// check if node can start the syncing routine
-	recv, _ := bufio.NewReader(conn).ReadString('\n')
-	if recv[:len(recv)-1] != "Okay" {
-		fmt.Println("Node unable to start syncing routine")
-		return false
-	}
-
-	// begin syncing the blockchain
-	for i:=0; i < heightDiff; i++ {
-		blockStringRaw, _ := bufio.NewReader(conn).ReadString('\n')
-		blockString := blockStringRaw[:len(blockStringRaw)-1]
-		block := blockchain.DeserialiseBlock(blockString)
-
-		blockValid, invalidReason := blockchain.VerifyBlock(block, prevBlock)
-
-		if blockValid {
-			blockId := strconv.Itoa((blockHeight+i)+1)
-			blockchain.Update(blockString, blockId)
-			prevBlock = block	
-		} else {
-			fmt.Printf("Block %d from network invalid!\n", (blockHeight+i))
-			fmt.Println("Invalid reason: ", invalidReason)
-			return false
-		}
-
-		fmt.Fprintf(conn, "Okay\n")
-	}
-
-	conn.Close()
-
-	return true
-}
\ No newline at end of file
@@ -3,24 +3,24 @@ package main
 import (
     "fmt"
     "net"
-    "bufio"
     "strconv"
     "flag"
-    b64 "encoding/base64"
     "encoding/json"
-    "io/ioutil"
+    "sync"
 
     "pocketcoin/coin"
     "pocketcoin/blockchain"
+    "pocketcoin/pgpcache"
+    "pocketcoin/mempool"
     "pocketcoin/netpack"
-    "pocketcoin/pgp"
 )
 
 type T = coin.Transaction
 type H = coin.RequestHeader
 
-var transactionPool []coin.Transaction
-var pgpCache []PGPCacheEntry
+var txPool = mempool.New(mempool.DefaultMaxSize, mempool.DefaultExpiry)
+var pgpCache = pgpcache.Load(pgpcache.DefaultFilename)
+var chainUpdateLock sync.Mutex
 
 
 
@@ -39,15 +39,11 @@ const (
     CONN_TYPE = "tcp"
 )
 
+const invalidBlockScore = 20  // ban score added to a peer for each invalid block it sends
+
 
-type PGPCacheEntry struct {
-    WalletAddress string
-    PublicKeyPem string
-}
 
 
-var minerPortList = []string{"2221", "2222", "2223", "2224", "2225"}
-var nodeList = []string{"5555", "5556", "5557", "5558", "5559"}
 
 
 func check(err error) {
@@ -60,6 +56,8 @@ func check(err error) {
 func main() {
     argBlockchainFolderPtr := flag.String("f", "", "folder that stores the nodes blockchain")
     argPortPtr := flag.String("p", "5555", "port that the node listens on")
+    argHostPtr := flag.String("host", CONN_ADDR, "host name or ip address that the node listens on, given to peers to connect back")
+    argParamsPtr := flag.String("params", blockchain.DefaultParamsFile, "network parameters file")
     flag.Parse()
 
     blockchainFolder := *argBlockchainFolderPtr
@@ -70,7 +68,31 @@ func main() {
         return
     }
 
-    blockchain.SetBlockchainFolder(blockchainFolder)
+    params, err := blockchain.LoadNetworkParams(*argParamsPtr)
+    if err != nil {
+        fmt.Println("Unable to load network parameters:", err)
+        return
+    }
+
+    err = blockchain.SetBlockchainFolder(blockchainFolder)
+    if err == nil {
+        err = blockchain.InitGenesis()
+    }
+    if err != nil {
+        fmt.Println("Unable to open blockchain:", err)
+        return
+    }
+    listenAddress := *argHostPtr + ":" + port
+    netpack.SetListenAddress(listenAddress)
+    netpack.SetLocalVersion(params.GenesisHash, "pocketcoin-node", netpack.ServiceBlocks, blockchain.Height)
+
+    // learn about more peers from the ones already known
+    netpack.LoadPeers(blockchainFolder + "/peers.json", params.SeedNodes, params.SeedMiners)
+    for _, address := range netpack.Peers(netpack.NodePeer) {
+        netpack.RequestPeers(address, "node")
+    }
+    netpack.SavePeers()
+    fmt.Printf("%d nodes and %d miners known\n", len(netpack.Peers(netpack.NodePeer)), len(netpack.Peers(netpack.MinerPeer)))
 
     fmt.Println("Checking blockchain...")
     blockchainValid, invalidBlock, invalidReason := blockchain.IsValid()
@@ -79,31 +101,48 @@ func main() {
     } else {
         fmt.Printf("Blockchain found invalid on block %d\n", invalidBlock)
         fmt.Println("Reason block is invalid:", invalidReason)
-        fmt.Println("Please repair blockchain\nExiting...")
-        return
+        fmt.Println("Repairing blockchain...")
+        err := blockchain.Repair(invalidBlock)
+        if err != nil {
+            fmt.Println("Unable to repair blockchain:", err)
+            return
+        }
+        fmt.Printf("Blocks from %d onwards removed, blockchain height is now %d\n", invalidBlock, blockchain.Height())
     }
 
+    blockchain.LoadBlockIndex()
+    blockchain.LoadChainState()
+
     // check if the blockchain height matches the networks, if not then sync the blockchain
     localBlockHeight := blockchain.Height()
-    bestNode, networkBlockHeight := blockchain.GetHighestNodeBlockHeight(nodeList)
+    _, networkBlockHeight := blockchain.GetHighestNodeBlockHeight(netpack.Peers(netpack.NodePeer))
     if localBlockHeight != networkBlockHeight && networkBlockHeight != 0 {
         fmt.Println("\nBlockchain out of sync!")
         fmt.Printf("Local block height: %d  |  Network block height: %d\n", localBlockHeight, networkBlockHeight)
-        heightDiff := (networkBlockHeight - localBlockHeight)
-        fmt.Printf("Number of missing blocks: %d\n", heightDiff)
         fmt.Println("Syncing blockchain...")
-        success := blockchain.SyncNodeBlockchain(localBlockHeight, heightDiff, bestNode)
-        if success {
-            fmt.Println("Blockchain synced!\n") 
+        _, err := blockchain.SyncBlockchain(netpack.Peers(netpack.NodePeer))
+        if err != nil {
+            fmt.Println("Unable to sync blockchain, trying again in the background:", err)
         } else {
-            return
+            fmt.Println("Blockchain synced! Height:", blockchain.Height())
         }
     }
 
-    loadPGPCache()
+    // pending transactions aren't kept between runs, so the cache only keeps the keys on the blockchain
+    // this also puts it back in step with the chain state after a crash or a repair
+    err = pgpCache.Rebuild()
+    if err != nil {
+        fmt.Println("Unable to rebuild the public key cache:", err)
+    }
+
+    // keep checking for blocks missed while offline or on another branch
+    nodePeers := func() []string {
+        return netpack.Peers(netpack.NodePeer)
+    }
+    go blockchain.KeepSynced(nodePeers, applyChainUpdate)
     
-    fmt.Println("listening on", CONN_ADDR + ":" + port);
-    ln, err := net.Listen(CONN_TYPE, CONN_ADDR + ":" + port)
+    fmt.Println("listening on", listenAddress);
+    ln, err := net.Listen(CONN_TYPE, listenAddress)
     check(err)
     for {
         conn, err := ln.Accept() // this blocks until connection or error
@@ -116,8 +155,26 @@ func main() {
 func handleConnection(conn net.Conn) {
     fmt.Println("New Connection From:", conn.RemoteAddr().String())
 
-    rawPacket, _ := bufio.NewReader(conn).ReadString('\n')
-    packet := netpack.DeserialisePacket(rawPacket)
+    peer, err := netpack.Accept(conn)
+    if err != nil {
+        fmt.Println("Handshake failed:", err)
+        return
+    }
+    defer peer.Close()
+    netpack.PeerSeen(peer.Address, netpack.PeerType(peer.Version.Services))
+
+    // the connection stays open for more packets until the peer closes it or it's idle for too long
+    for {
+        packet, err := peer.ReadPacket()
+        if err != nil {
+            return
+        }
+        handlePacket(peer, packet)
+    }
+}
+
+
+func handlePacket(peer *netpack.Conn, packet coin.NetworkPacket) {
     head := packet.Header
 
     blockchain.PrettyPrint(packet)
@@ -125,40 +182,88 @@ func handleConnection(conn net.Conn) {
     // process the body correctly
     switch head.Request {
     case "Transaction":
-        handleTransaction(packet.Body)
+        handleTransaction(packet.Body, peer)
+    case "SubmitTransaction":
+        responsePacket := handleSubmitTransaction(packet.Body, peer)
+        peer.Send(responsePacket)
     case "Balance":
         responsePacket := handleBalanceRequest(packet.Body)
-        conn.Write([]byte(responsePacket))
+        peer.Send(responsePacket)
     case "MinedBlock":
-        handleBlockMined(packet.Body)
+        handleBlockMined(packet.Body, peer)
+    case "GetBlockByHash":
+        responsePacket := handleGetBlockByHash(packet.Body)
+        peer.Send(responsePacket)
     case "BlockHeight":
         responsePacket := handleBlockHeight()
-        conn.Write([]byte(responsePacket))
-    case "SyncBlockchain":
-        syncBlockchain(conn, packet.Body)
+        peer.Send(responsePacket)
+    case "GetHeaders":
+        responsePacket := handleGetHeaders(packet.Body)
+        peer.Send(responsePacket)
+    case "GetBlocks":
+        responsePacket := handleGetBlocks(packet.Body)
+        peer.Send(responsePacket)
     case "PublicKeyInCache":
         responsePacket := handlePublicKeyInCache(packet.Body)
-        conn.Write([]byte(responsePacket))
+        peer.Send(responsePacket)
+    case "UnspentOutputs":
+        responsePacket := handleUnspentOutputs(packet.Body)
+        peer.Send(responsePacket)
+    case "MerkleProof":
+        responsePacket := handleMerkleProof(packet.Body)
+        peer.Send(responsePacket)
+    case "AccountNonce":
+        responsePacket := handleAccountNonce(packet.Body)
+        peer.Send(responsePacket)
+    case "GetTransaction":
+        responsePacket := handleGetTransaction(packet.Body)
+        peer.Send(responsePacket)
+    case "GetPeers":
+        peer.Send(netpack.PeersPacket("node"))
+    case "Peers":
+        netpack.AddPeerAddresses(packet.Body)
+    case "Inv":
+        netpack.RequestInventory("node", peer, packet.Body, haveInventory)
+    case "GetData":
+        handleGetData(packet.Body, peer)
     }
-
-    conn.Close()
 }
 
 
-func handleTransaction(bodyString string) {
+// returns why the transaction wasn't added to the pool, or "" if it was
+func handleTransaction(bodyString string, peer *netpack.Conn) string {
     tx := blockchain.DeserialiseTransaction(bodyString)
-    if transactionValid(tx) {
-        if !publicKeyInCache(tx.FromAddress) {
+    netpack.MarkKnown(peer.Address, blockchain.TransactionHash(tx))
+    reason := ""
+    if !transactionValid(tx) {
+        reason = "transaction invalid"
+        fmt.Println("Recieved transaction invalid!")
+    } else if err := txPool.Add(tx); err != nil {
+        reason = err.Error()
+        fmt.Println("Transaction not added to the pool:", err)
+    } else {
+        if !publicKeyInCache(tx.FromAddress) && publicKeyProven(tx) {
             addToPgpCache(tx.FromAddress, tx.PublicKey)
         }
-        transactionPool = append(transactionPool, tx)
-        broadcastTransaction(bodyString)
-        fmt.Printf("Number of transactions in pool: %d\n", len(transactionPool))
-    } else {
-        fmt.Println("Recieved transaction invalid!")
+        broadcastTransaction(tx)
+        fmt.Printf("Number of transactions in pool: %d\n", txPool.Count())
     }
     
     blockchain.PrettyPrint(tx)
+    return reason
+}
+
+
+// wallets submit transactions with a reply so they know whether any node took it,
+// the body is empty if the transaction was added to the pool or says why it wasn't
+func handleSubmitTransaction(bodyString string, peer *netpack.Conn) string {
+    reason := handleTransaction(bodyString, peer)
+
+    respHeader := netpack.ConstructRequestHeader("node", "SubmitTransaction")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, reason)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
 }
 
 
@@ -166,7 +271,7 @@ func handleBalanceRequest(bodyString string) string {
     walletAddr := bodyString
     // verify wallet address is valid
     balance := getWalletBalanceWithPool(walletAddr)
-    balanceString := fmt.Sprintf("%f", balance)
+    balanceString := coin.FormatAmount(balance)
 
     respHeader := netpack.ConstructRequestHeader("node", "Response")
     respPacket := netpack.ConstructNetworkPacket(respHeader, balanceString)
@@ -176,34 +281,194 @@ func handleBalanceRequest(bodyString string) string {
 }
 
 
-func handleBlockMined(newBlockString string) {
+// responds with the nonce the wallets next transaction needs, counting its transactions in the pool
+func handleAccountNonce(walletAddress string) string {
+    nonce := getWalletNonceWithPool(walletAddress)
+
+    respHeader := netpack.ConstructRequestHeader("node", "AccountNonce")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, strconv.Itoa(nonce))
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
+}
+
+
+// peer is the connection the block arrived on, invalid blocks add to its ban score
+func handleBlockMined(newBlockString string, peer *netpack.Conn) {
     newBlock := blockchain.DeserialiseBlock(newBlockString)
-    prevBlock := blockchain.GetHighestBlock()
-    blockValid, invalidReason := blockchain.VerifyBlock(newBlock, prevBlock)
+    if processPeerBlock(newBlock, peer) == blockchain.OrphanBlockReason {
+        requestMissingBlocks(blockchain.OrphanRoot(newBlock.Hash), peer)
+        blockchain.RequestSync()
+    }
+}
+
+
+// adds a block from a peer to the blockchain, returns the reason ProcessBlock gave
+func processPeerBlock(newBlock coin.Block, peer *netpack.Conn) string {
+    netpack.MarkKnown(peer.Address, newBlock.Hash)
+    update, accepted, reason := blockchain.ProcessBlock(newBlock)
+
+    if reason == blockchain.OrphanBlockReason {
+        fmt.Printf("Orphan block received, %d blocks in the orphan pool\n", blockchain.OrphanCount())
+        return reason
+    } else if !accepted {
+        fmt.Println("Block invalid. Reason:", reason)
+        if reason != blockchain.KnownBlockReason {
+            peer.Misbehaving(invalidBlockScore, reason)
+        }
+        return reason
+    }
 
-    if blockValid {
-        blockId := strconv.Itoa(blockchain.Height() + 1)
-        blockchain.Update(newBlockString, blockId)
+    if len(update.Disconnected) > 0 {
+        fmt.Printf("Blockchain reorganised! %d blocks disconnected, %d blocks connected\n", len(update.Disconnected), len(update.Connected))
+    } else if len(update.Connected) > 0 {
         fmt.Println("New Block Mined!")
-        broadcastNewBlock(newBlockString)
-        updateTransactionPool(newBlock)
     } else {
-        fmt.Println("Block invalid. Reason:", invalidReason)
+        fmt.Println("Block added to a side branch")
     }
-    
+
+    broadcastNewBlock(newBlock)
+    applyChainUpdate(update)
+    return reason
 }
 
 
-func broadcastNewBlock(newBlockString string) {
-    reqHeader := netpack.ConstructRequestHeader("node", "MinedBlock")
-    packet := netpack.ConstructNetworkPacket(reqHeader, newBlockString)
-    packetString, _ := blockchain.Serialise(packet)
-    for _, addr := range minerPortList {
-        netpack.BroadcastPacket(packetString, addr)
+func applyChainUpdate(update blockchain.ChainUpdate) {
+    // updates come from connections and the background sync
+    chainUpdateLock.Lock()
+    defer chainUpdateLock.Unlock()
+
+    var confirmedTxs []coin.Transaction
+    for _, block := range update.Connected {
+        txPool.RemoveBlock(block)
+        confirmedTxs = append(confirmedTxs, block.Body...)
+    }
+
+    // return transactions from the disconnected blocks to the pool, oldest block first
+    for i := len(update.Disconnected) - 1; i >= 0; i-- {
+        for _, tx := range update.Disconnected[i].Body[1:] {
+            if !transactionInList(tx, confirmedTxs) && transactionValid(tx) {
+                txPool.Add(tx)
+            }
+        }
+    }
+}
+
+
+// fetches the missing parents of an orphan block from the peer that sent the orphan, at the address verified
+// for its connection, if there isn't one the background sync fetches the missing blocks instead
+// each parent can be another orphan so they're fetched in a loop, capped so a peer that keeps
+// answering with new parents can't keep the node fetching forever
+func requestMissingBlocks(blockHash string, peer *netpack.Conn) {
+    address := peer.Address
+    if address == "" {
+        return
+    }
+
+    for i := 0; i < blockchain.MaxOrphanBlocks; i++ {
+        reqHeader := netpack.ConstructRequestHeader("node", "GetBlockByHash")
+        packet := netpack.ConstructNetworkPacket(reqHeader, blockHash)
+        packetString, _ := blockchain.Serialise(packet)
+        success, response := netpack.BroadcastDuplexPacket(packetString, address)
+        if !success || response.Body == "" {
+            return
+        }
+
+        block := blockchain.DeserialiseBlock(response.Body)
+        if block.Hash != blockHash || processPeerBlock(block, peer) != blockchain.OrphanBlockReason {
+            return
+        }
+        blockHash = blockchain.OrphanRoot(block.Hash)
+    }
+}
+
+
+func handleGetBlockByHash(blockHash string) string {
+    blockString := ""
+    block, found := blockchain.GetBlockByHash(blockHash)
+    if found {
+        blockString, _ = blockchain.Serialise(block)
+    }
+
+    respHeader := netpack.ConstructRequestHeader("node", "GetBlockByHash")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, blockString)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
+}
+
+
+// announces the block to the peers that don't have it yet, they ask for it with GetData
+func broadcastNewBlock(block coin.Block) {
+    item := coin.InvItem{Type: netpack.InvBlock, Hash: block.Hash}
+    netpack.Announce("node", item, relayPeers())
+}
+
+
+func relayPeers() []string {
+    return append(netpack.Peers(netpack.NodePeer), netpack.Peers(netpack.MinerPeer)...)
+}
+
+
+// returns whether the node already has an item announced in an Inv
+func haveInventory(item coin.InvItem) bool {
+    if item.Type == netpack.InvBlock {
+        return blockchain.BlockKnown(item.Hash)
+    }
+    _, confirmed := blockchain.FindTransaction(item.Hash)
+    return confirmed || txPool.Has(item.Hash)
+}
+
+
+// sends the requested transactions and blocks to the peer as Transaction and MinedBlock messages
+// they're sent to the address verified for the connection the GetData arrived on
+func handleGetData(bodyString string, peer *netpack.Conn) {
+    address := peer.Address
+    if address == "" {
+        return
+    }
+
+    for _, item := range netpack.InventoryItems(bodyString) {
+        request := ""
+        itemString := ""
+        if item.Type == netpack.InvBlock {
+            block, found := blockchain.GetBlockByHash(item.Hash)
+            if found {
+                request = "MinedBlock"
+                itemString, _ = blockchain.Serialise(block)
+            }
+        } else if tx, found := txPool.Get(item.Hash); found {
+            request = "Transaction"
+            itemString, _ = blockchain.Serialise(tx)
+        }
+        if request == "" {
+            continue
+        }
+
+        reqHeader := netpack.ConstructRequestHeader("node", request)
+        packet := netpack.ConstructNetworkPacket(reqHeader, itemString)
+        packetString, _ := blockchain.Serialise(packet)
+        netpack.BroadcastPacket(packetString, address)
+        netpack.MarkKnown(address, item.Hash)
     }
-    for _, addr := range nodeList {
-        netpack.BroadcastPacket(packetString, addr)
+}
+
+
+// responds with the wallets unspent outputs, excluding outputs already spent by transactions in the pool
+func handleUnspentOutputs(walletAddress string) string {
+    unspentOutputs := []coin.UnspentOutput{}
+    for _, unspent := range blockchain.UnspentOutputs(walletAddress) {
+        if !txPool.OutputSpent(unspent.TxId, unspent.OutputIndex) {
+            unspentOutputs = append(unspentOutputs, unspent)
+        }
     }
+    outputsString, _ := blockchain.Serialise(unspentOutputs)
+
+    respHeader := netpack.ConstructRequestHeader("node", "UnspentOutputs")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, outputsString)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
 }
 
 
@@ -233,39 +498,117 @@ func handlePublicKeyInCache(walletAddress string) string {
 }
 
 
-func syncBlockchain(conn net.Conn, blockHeightString string) {
-    conn.Write([]byte("Okay\n"))
-    minerBlockHeight, _ := strconv.Atoi(blockHeightString)
-    blockHeight := blockchain.Height()
+// responds with a proof that a transaction is in a block, body is left empty if the block or transaction isn't found
+func handleMerkleProof(bodyString string) string {
+    proofRequest := coin.MerkleProofRequest{}
+    json.Unmarshal([]byte(bodyString), &proofRequest)
+
+    proofString := ""
+    blockHeight, _ := strconv.Atoi(proofRequest.BlockId)
+    blockString, err := blockchain.LoadBlock(blockHeight)
+    if err == nil {
+        block := blockchain.DeserialiseBlock(blockString)
+        proof, found := blockchain.MerkleProof(block, proofRequest.TxHash)
+        if found {
+            proofString, _ = blockchain.Serialise(proof)
+        }
+    }
 
+    respHeader := netpack.ConstructRequestHeader("node", "MerkleProof")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, proofString)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
+}
 
-    for i:=minerBlockHeight+1; i <= blockHeight; i++ {
-        filename := "block_" + strconv.Itoa(i) + ".blk"
-        blockString, _ := blockchain.LoadBlock(filename)
-        conn.Write([]byte(blockString + "\n"))
 
-        blockSuccess, _ := bufio.NewReader(conn).ReadString('\n')
-        if blockSuccess != "Okay\n" {
-            break
-        }
+// responds with the transaction and where it is, body is left empty if it isn't in the pool or the main chain
+func handleGetTransaction(txId string) string {
+    statusString := ""
+    status, found := transactionStatus(txId)
+    if found {
+        statusString, _ = blockchain.Serialise(status)
     }
+
+    respHeader := netpack.ConstructRequestHeader("node", "GetTransaction")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, statusString)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
 }
 
 
-func broadcastTransaction(txString string) {
-    reqHeader := netpack.ConstructRequestHeader("node", "Transaction")
-    packet := netpack.ConstructNetworkPacket(reqHeader, txString)
-    packetString, _ := blockchain.Serialise(packet)
-    for _, addr := range minerPortList {
-        netpack.BroadcastPacket(packetString, addr)
+func transactionStatus(txId string) (coin.TransactionStatus, bool) {
+    status := coin.TransactionStatus{TxId: txId, BlockHeight: -1}
+
+    if tx, pending := txPool.Get(txId); pending {
+        status.Transaction = tx
+        status.Pending = true
+        return status, true
     }
-    for _, addr := range nodeList {
-        netpack.BroadcastPacket(packetString, addr)
+
+    location, found := blockchain.FindTransaction(txId)
+    if !found {
+        return status, false
+    }
+    blockString, err := blockchain.LoadBlock(location.Height)
+    if err != nil {
+        return status, false
     }
+    block := blockchain.DeserialiseBlock(blockString)
+    if location.Index >= len(block.Body) || coin.TransactionId(block.Body[location.Index]) != txId {
+        // the block was replaced by a reorg since it was looked up
+        return status, false
+    }
+
+    status.Transaction = block.Body[location.Index]
+    status.BlockHeight = location.Height
+    status.BlockHash = block.Hash
+    status.Confirmations = blockchain.Height() - location.Height + 1
+    return status, true
+}
+
+
+// responds with the main chain headers after the locator, used by syncing peers
+func handleGetHeaders(bodyString string) string {
+    headersRequest := coin.GetHeadersRequest{}
+    json.Unmarshal([]byte(bodyString), &headersRequest)
+    headersString, _ := blockchain.Serialise(blockchain.HeadersAfter(headersRequest.Locator))
+
+    respHeader := netpack.ConstructRequestHeader("node", "Headers")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, headersString)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
+}
+
+
+// responds with the requested blocks, stopping at the first one that isn't known
+func handleGetBlocks(bodyString string) string {
+    var hashes []string
+    json.Unmarshal([]byte(bodyString), &hashes)
+    blocksString, _ := blockchain.Serialise(blockchain.BlocksByHash(hashes))
+
+    respHeader := netpack.ConstructRequestHeader("node", "Blocks")
+    respPacket := netpack.ConstructNetworkPacket(respHeader, blocksString)
+    packetString, _ := blockchain.Serialise(respPacket)
+
+    return packetString
+}
+
+
+// announces the transaction to the peers that don't have it yet, they ask for it with GetData
+func broadcastTransaction(tx coin.Transaction) {
+    item := coin.InvItem{Type: netpack.InvTransaction, Hash: blockchain.TransactionHash(tx)}
+    netpack.Announce("node", item, relayPeers())
 }
 
 
 func transactionValid(tx coin.Transaction) bool {
+    if blockchain.IsUTXOTransaction(tx) {
+        return utxoTransactionValid(tx)
+    }
+
     balance := getWalletBalanceWithPool(tx.FromAddress)
     publicKeyPem, publicKeyExists := getWalletPublicKeyPem(tx)
     var valid bool
@@ -275,11 +618,13 @@ func transactionValid(tx coin.Transaction) bool {
         publicKeyHash = blockchain.SHA256([]byte(publicKeyPem))[:32]
     }
 
-    if tx.Amount <= 0 || tx.Amount > balance {
+    if tx.Amount <= 0 || tx.Fee < 0 || tx.Fee > balance || tx.Amount > balance - tx.Fee {
         valid = false
     } else if tx.FromAddress == tx.ToAddress {
         valid = false
-    } else if transactionInList(tx, transactionPool) {
+    } else if txPool.Has(blockchain.TransactionHash(tx)) {
+        valid = false
+    } else if tx.Nonce != getWalletNonceWithPool(tx.FromAddress) {
         valid = false
     } else if !publicKeyExists {
         valid = false
@@ -295,57 +640,59 @@ func transactionValid(tx coin.Transaction) bool {
 }
 
 
-func transactionSignatureValid(tx coin.Transaction, publicKeyPem string) bool {
-    signatureString := tx.Signature
-    tx.Signature = ""
-
-    publicKey, _ := pgp.ParsePublicKeyFromPemStr(publicKeyPem)
-    txString, _ := blockchain.Serialise(tx)
-    signature, _ := b64.StdEncoding.DecodeString(signatureString)
-
-    valid := pgp.ValidSignature(txString, signature, publicKey)
-
-    return valid
-}
-
-
-func getWalletBalance(wallet string) float64 {
-    networkHeight := blockchain.Height()
-    balance := 0.0
-
-    for i:=0; i <= networkHeight; i++ {
-        filename := "block_" + strconv.Itoa(i) + ".blk"
-        blockString, _ := blockchain.LoadBlock(filename)
-        block := blockchain.DeserialiseBlock(blockString)
-
-        for _, tx := range block.Body {
-            if tx.ToAddress == wallet {
-                balance += tx.Amount
-            } else  if tx.FromAddress == wallet {
-                balance -= tx.Amount
-            }
+func utxoTransactionValid(tx coin.Transaction) bool {
+    // input owners other than the sender must already have their public key cached
+    publicKeyLookup := func(walletAddress string) (string, bool) {
+        if walletAddress == tx.FromAddress {
+            return getWalletPublicKeyPem(tx)
+        } else if publicKeyInCache(walletAddress) {
+            return getPublicKeyFromCache(walletAddress), true
         }
+        return "", false
     }
-    return balance
-}
 
+    valid, invalidReason := blockchain.ValidUTXOTransaction(tx, publicKeyLookup)
+    if !valid {
+        fmt.Println("UTXO transaction invalid:", invalidReason)
+        return false
+    }
 
-func getWalletBalanceWithPool(wallet string) float64 {
-    balance := getWalletBalance(wallet)
+    if tx.FromAddress == "" || tx.Amount > getWalletBalanceWithPool(tx.FromAddress) {
+        return false
+    } else if txPool.Has(blockchain.TransactionHash(tx)) {
+        return false
+    } else if blockchain.SpendsFromAccount(tx) && tx.Nonce != getWalletNonceWithPool(tx.FromAddress) {
+        return false
+    }
 
-    for _, tx := range transactionPool {
-        if tx.FromAddress == wallet {
-            balance -= tx.Amount
+    for _, input := range tx.Inputs {
+        if txPool.OutputSpent(input.PrevTxId, input.OutputIndex) {
+            fmt.Println("UTXO transaction conflicts with a transaction in the pool")
+            return false
         }
     }
 
-    return balance
+    return true
 }
 
 
-func transactionInList(tx coin.Transaction, blockBody []coin.Transaction) bool {
-    for _, blockTx := range blockBody {
-        if tx == blockTx {
+func transactionSignatureValid(tx coin.Transaction, publicKeyPem string) bool {
+    return blockchain.SignatureValid(blockchain.SigningString(tx), tx.Signature, publicKeyPem)
+}
+
+
+// a public key is only cached if it hashes to the sender's address and signed the transaction,
+// either as the sender's signature or the signature of one of its inputs
+func publicKeyProven(tx coin.Transaction) bool {
+    if tx.PublicKey == "" || blockchain.SHA256([]byte(tx.PublicKey))[:32] != tx.FromAddress {
+        return false
+    }
+    if tx.Signature != "" && transactionSignatureValid(tx, tx.PublicKey) {
+        return true
+    }
+    signingString := blockchain.SigningString(tx)
+    for _, input := range tx.Inputs {
+        if blockchain.SignatureValid(signingString, input.Signature, tx.PublicKey) {
             return true
         }
     }
@@ -353,56 +700,48 @@ func transactionInList(tx coin.Transaction, blockBody []coin.Transaction) bool {
 }
 
 
-func updateTransactionPool(block coin.Block) {
-    for _, tx := range block.Body[1:] {
-        txIndex := indexInTxPool(transactionPool, tx)
-        if txIndex != -1 {
-            transactionPool = append(transactionPool[:txIndex], transactionPool[txIndex+1:]...)
-        }
-    }
+func getWalletBalance(wallet string) int64 {
+    return blockchain.Balance(wallet)
 }
 
 
-func indexInTxPool(list []coin.Transaction, item coin.Transaction) int {
-    for i, elm := range list {
-        if elm == item {
-            return i
-        }
-    }
-    return -1
+func getWalletBalanceWithPool(wallet string) int64 {
+    return getWalletBalance(wallet) - txPool.Debit(wallet)
 }
 
 
-func loadPGPCache() {
-    cacheString, _ := ioutil.ReadFile("NodeCache/pgpCache.txt")
-    json.Unmarshal([]byte(cacheString), &pgpCache)
+func getWalletNonce(wallet string) int {
+    return blockchain.AccountNonce(wallet)
 }
 
 
-func addToPgpCache(walletAddress string, PublicKeyPem string) {
-    cacheEntry := PGPCacheEntry{}
-    cacheEntry.WalletAddress = walletAddress
-    cacheEntry.PublicKeyPem = PublicKeyPem
+func getWalletNonceWithPool(wallet string) int {
+    return getWalletNonce(wallet) + txPool.PendingNonces(wallet)
+}
 
-    pgpCache = append(pgpCache, cacheEntry)
-    savePgpCacheFile()
 
+func transactionInList(tx coin.Transaction, blockBody []coin.Transaction) bool {
+    txHash := blockchain.TransactionHash(tx)
+    for _, blockTx := range blockBody {
+        if blockchain.TransactionHash(blockTx) == txHash {
+            return true
+        }
+    }
+    return false
 }
 
 
-func savePgpCacheFile() {
-    cacheString, _ := blockchain.Serialise(pgpCache)
-    _ = ioutil.WriteFile("NodeCache/pgpCache.txt", []byte(cacheString), 0644)
+func addToPgpCache(walletAddress string, PublicKeyPem string) {
+    err := pgpCache.Add(walletAddress, PublicKeyPem)
+    if err != nil {
+        fmt.Println("Unable to save the public key cache:", err)
+    }
 }
 
 
 func publicKeyInCache(walletAddress string) bool {
-    for _, txCacheEntry := range pgpCache {
-        if walletAddress == txCacheEntry.WalletAddress {
-            return true
-        }
-    }
-    return false
+    _, found := pgpCache.Get(walletAddress)
+    return found
 }
 
 
@@ -418,11 +757,7 @@ func getWalletPublicKeyPem(tx coin.Transaction) (string, bool) {
 
 
 func getPublicKeyFromCache(walletAddress string) string {
-    for _, txCacheEntry := range pgpCache {
-        if walletAddress == txCacheEntry.WalletAddress {
-            return txCacheEntry.PublicKeyPem
-        }
-    }
-    return ""
+    publicKeyPem, _ := pgpCache.Get(walletAddress)
+    return publicKeyPem
 }
 
@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"os"
+	"pocketcoin/fileutil"
+	"time"
+)
+
+
+// ---- Crash Safe Updates ----
+// files are written with fileutil.AtomicWriteFile so a crash leaves either the old file or the new one
+// updates that change several files (block file, index, chain state) write an update marker first and remove it once they're done
+// if the marker is still there when the block store is next opened the update was interrupted, so the index is rebuilt from the block file
+
+
+const updateMarkerFilename = "update.pending"
+
+
+func beginUpdate() error {
+	return fileutil.AtomicWriteFile(blockchainFolder + "/" + updateMarkerFilename, []byte(time.Now().String()), 0644)
+}
+
+
+func endUpdate() error {
+	err := os.Remove(blockchainFolder + "/" + updateMarkerFilename)
+	fileutil.SyncDir(blockchainFolder)
+	return err
+}
+
+
+// undoes an update whose block append failed, truncating back to the height also drops a partly written block
+// the marker is only removed if the block store is back how it was before the update
+func abortUpdate(height int) {
+	if blockStore.Truncate(height) == nil {
+		endUpdate()
+	}
+}
+
+
+func updateInterrupted(folder string) bool {
+	_, err := os.Stat(folder + "/" + updateMarkerFilename)
+	return err == nil
+}
+
+
+// Repair truncates the main chain back to the last valid block, invalidBlock is the height IsValid returned
+// needs to be called before LoadBlockIndex, the removed blocks can then be synced from the network again
+func Repair(invalidBlock int) error {
+	return Rollback(invalidBlock - 1)
+}
+
+
+// Rollback removes every main chain block above the given height, needs to be called before LoadBlockIndex
+// the chain state snapshot is rebuilt by LoadChainState if it was taken at a removed block
+func Rollback(height int) error {
+	err := beginUpdate()
+	if err != nil {
+		return err
+	}
+
+	err = blockStore.Truncate(height)
+	if err != nil {
+		return err
+	}
+
+	return endUpdate()
+}
@@ -1,58 +1,116 @@
 package blockchain
 
 import (
-	"io/ioutil"
-	"bufio"
+	"errors"
 	"pocketcoin/coin"
 	"pocketcoin/netpack"
+	"pocketcoin/merkle"
 	"strconv"
-	"net"
 	"encoding/json"
 	"fmt"
 	"crypto/sha256"
 )
 
-var blockchainFolder string = "Blockchain"
+var blockchainFolder string
+var blockStore BlockStore  // the main chain, see blockstore.go
 
 
-func SetBlockchainFolder(folder string) {
+// SetBlockchainFolder opens the block store in the folder, needs to be called before the blockchain is used
+func SetBlockchainFolder(folder string) error {
+	if blockStore != nil {
+		blockStore.Close()
+	}
 	blockchainFolder = folder
+	tipState = nil
+
+	var err error
+	blockStore, err = OpenBlockStore(folder)
+	return err
+}
+
+
+// OpenBlockchainReadOnly opens a blockchain folder and builds its chain state in memory without writing to the folder,
+// used by tools that can be pointed at the folder of a running node, needs to be called after LoadNetworkParams
+func OpenBlockchainReadOnly(folder string) error {
+	if blockStore != nil {
+		blockStore.Close()
+	}
+	blockchainFolder = folder
+	tipState = nil
+
+	var err error
+	blockStore, err = OpenBlockStoreReadOnly(folder)
+	if err != nil {
+		return err
+	}
+
+	genesisHash, found := blockStore.BlockHash(0)
+	if !found {
+		return errors.New("blockchain is empty")
+	} else if !genesisValid(genesisHash) {
+		return errors.New("blockchain was created with a different genesis block than " + networkParams.NetworkName)
+	}
+
+	chainLock.Lock()
+	tipState = buildChainState()
+	chainLock.Unlock()
+	return nil
 }
 
 
 func Height() int {
-	block_files, _ := ioutil.ReadDir(blockchainFolder)
-	return len(block_files) - 1
+	return blockStore.Height()
 }
 
 
 func GetHighestBlock() coin.Block {
-	currentBlockHeight := Height()
-	blockFilename := "block_" + strconv.Itoa(currentBlockHeight) + ".blk"
-	blockString, _ := LoadBlock(blockFilename)
+	blockString, _ := LoadBlock(Height())
 	block := DeserialiseBlock(blockString)
 
 	return block
 }
 
 
-func LoadBlock(blockFilename string) (string, error) {
-	filepath := blockchainFolder + "/" + string(blockFilename)
-	data, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		return "", err
-	}
+// LoadBlock returns the serialised main chain block at the given height
+func LoadBlock(height int) (string, error) {
+	return blockStore.LoadBlock(height)
+}
+
+
+// HeightOfHash returns the height of a block in the main chain
+func HeightOfHash(blockHash string) (int, bool) {
+	return blockStore.HeightOfHash(blockHash)
+}
+
 
-	return string(data), nil
+// FindTransaction returns where a transaction is in the main chain
+func FindTransaction(txId string) (TxLocation, bool) {
+	return blockStore.FindTransaction(txId)
 }
 
 
+// Update adds a block on top of the main chain, block_id has to be the next height
 func Update(serialisedBlock string, block_id string) error {
-	block_bytes := []byte(serialisedBlock)
-	filepath := blockchainFolder + "/block_" + block_id + ".blk"
-	err := ioutil.WriteFile(filepath, block_bytes, 0644)
+	if block_id != strconv.Itoa(Height() + 1) {
+		return errors.New("block " + block_id + " does not follow the highest block")
+	}
 
-	return err
+	block := DeserialiseBlock(serialisedBlock)
+	err := beginUpdate()
+	if err != nil {
+		return err
+	}
+	err = blockStore.Append(block)
+	if err != nil {
+		abortUpdate(Height())
+		return err
+	}
+
+	chainLock.Lock()
+	connectTipState(block)
+	chainLock.Unlock()
+
+	return endUpdate()
 }
 
 
@@ -63,40 +121,166 @@ func SHA256(byteData []byte) string {
 }
 
 
+// VerifyBlock checks the block header and every transaction against the chain state of the previous block
 func VerifyBlock(block coin.Block, prevBlock coin.Block) (bool, string) {
-	// check block hash has correct number of leading zeros
-	blockHashLeading := block.Hash[0:6]
-	if blockHashLeading != "000000"{
-		return false, "Block hash leading zeros invalid"
+	headerValid, invalidReason := verifyBlockHeader(block, prevBlock)
+	if !headerValid {
+		return false, invalidReason
+	}
+
+	state, found := chainStateAt(prevBlock)
+	if !found {
+		return false, "Unable to load the chain state of the previous block"
+	}
+
+	return state.ConnectBlock(block)
+}
+
+
+func verifyBlockHeader(block coin.Block, prevBlock coin.Block) (bool, string) {
+	headerValid, invalidReason := verifyHeader(block.Hash, block.Header, prevBlock.Hash, prevBlock.Header, blockTarget(prevBlock))
+	if !headerValid {
+		return false, invalidReason
+	}
+
+	// Check the merkle root of the transaction body
+	if MerkleRoot(block.Body) != block.Header.MerkleRoot {
+		return false, "Merkle root hash invalid"
+	}
+
+	return true, ""
+}
+
+
+// verifyHeader checks a header follows on from the previous header, target is the target it has to be mined with
+func verifyHeader(hash string, header coin.BlockHeader, prevHash string, prevHeader coin.BlockHeader, target uint32) (bool, string) {
+	// versions above the networks block version are unknown, and a chain never goes back to an older version
+	if header.Version > BlockVersion || header.Version < prevHeader.Version {
+		return false, "Block version invalid"
+	}
+
+	// check the block is mined with the expected target
+	if header.TargetBits != target {
+		return false, "Block target invalid"
+	}
+	if !HashMeetsTarget(hash, header.TargetBits) {
+		return false, "Block hash does not meet target"
 	}
 
 	// check the previous block hash
-	prevBlockHeaderHash := prevBlock.Hash
-	if prevBlockHeaderHash != block.Header.PrevBlockHash {
+	if prevHash != header.PrevBlockHash {
 		return false, "Previous block hash invalid"
 	}
 
-	// Check the transaction body hash
-	blockBodyString, _ := Serialise(block.Body)
-	blockBodyHash := SHA256([]byte(blockBodyString))
-	if blockBodyHash != block.Header.MerkleRoot {
-		return false, "Merkle root hash invalid"
+	// check the block id follows on from the previous block
+	prevBlockId, _ := strconv.Atoi(prevHeader.BlockId)
+	if header.BlockId != strconv.Itoa(prevBlockId + 1) {
+		return false, "Block id invalid"
+	}
+
+	if !timestampValid(header, prevHeader) {
+		return false, "Block timestamp invalid"
 	}
 
 	// Check the block hash
-	blockHeaderString, _ := Serialise(block.Header)
-	firstHash := SHA256([]byte(blockHeaderString))
-	checkHash := SHA256([]byte(firstHash))
-	if block.Hash != checkHash {
+	if hash != HeaderHash(header) {
 		return false, "Block hash invalid"
 	}
 
-	// check coinbase transaction is the specified amount
-	if block.Body[0].Amount != 10{
-		return false, "Coinbase transaction amount invalid"
+	return true, ""
+}
+
+
+// AccountDebit is the amount taken from the senders account balance, UTXO transactions pay their fee out of the amount they spend
+func AccountDebit(tx coin.Transaction) int64 {
+	if IsUTXOTransaction(tx) {
+		return tx.Amount
+	}
+	return tx.Amount + tx.Fee
+}
+
+
+func TotalFees(transactions []coin.Transaction) int64 {
+	fees := int64(0)
+	for _, tx := range transactions {
+		fees += tx.Fee
 	}
+	return fees
+}
 
-	return true, ""
+
+func TransactionSize(tx coin.Transaction) int {
+	return len(coin.EncodeTransaction(tx))
+}
+
+
+// HigherFeeRate reports whether a pays more fee per byte than b
+func HigherFeeRate(a coin.Transaction, b coin.Transaction) bool {
+	return a.Fee * int64(TransactionSize(b)) > b.Fee * int64(TransactionSize(a))
+}
+
+
+func DoubleSHA256(byteData []byte) string {
+	firstHash := sha256.Sum256(byteData)
+	return SHA256(firstHash[:])
+}
+
+
+// HeaderHash hashes the headers binary encoding, this is the block hash
+func HeaderHash(header coin.BlockHeader) string {
+	return DoubleSHA256(coin.EncodeBlockHeader(header))
+}
+
+
+// HeaderTemplate splits the encoded header either side of the nonce, used by the mining engine
+func HeaderTemplate(header coin.BlockHeader) ([]byte, []byte) {
+	encodedHeader := coin.EncodeBlockHeader(header)
+	nonceStart := len(encodedHeader) - coin.HeaderNonceSize
+
+	return encodedHeader[:nonceStart], encodedHeader[nonceStart+coin.HeaderNonceSize:]
+}
+
+
+func TransactionHash(tx coin.Transaction) string {
+	return coin.TransactionId(tx)
+}
+
+
+func TransactionHashes(body []coin.Transaction) []string {
+	hashes := make([]string, len(body))
+	for i, tx := range body {
+		hashes[i] = TransactionHash(tx)
+	}
+	return hashes
+}
+
+
+func MerkleRoot(body []coin.Transaction) string {
+	return merkle.Root(TransactionHashes(body))
+}
+
+
+// MerkleProof builds an inclusion proof for the transaction with the given hash
+func MerkleProof(block coin.Block, txHash string) (coin.MerkleProof, bool) {
+	proof := coin.MerkleProof{}
+	hashes := TransactionHashes(block.Body)
+
+	for i, hash := range hashes {
+		if hash == txHash {
+			branch, _ := merkle.Branch(hashes, i)
+			proof.Header = block.Header
+			proof.TxHash = txHash
+			proof.Index = i
+			proof.Branch = branch
+			return proof, true
+		}
+	}
+	return proof, false
+}
+
+
+func VerifyMerkleProof(proof coin.MerkleProof) bool {
+	return merkle.VerifyBranch(proof.TxHash, proof.Index, proof.Branch, proof.Header.MerkleRoot)
 }
 
 
@@ -146,15 +330,24 @@ func PrettyPrint(data interface{}) {
 
 
 func IsValid() (bool, int, string) {
-	prevBlockString, _ := LoadBlock("block_0.blk")
+	prevBlockString, _ := LoadBlock(0)
 	prevBlock := DeserialiseBlock(prevBlockString)
 	height := Height()
+	if !genesisValid(prevBlock.Hash) {
+		return false, 0, "Genesis block does not match the network parameters"
+	}
+
+	// the chain state is built up as each block is checked rather than reloaded for every block
+	state := NewChainState()
+	state.ApplyBlock(prevBlock)
 
 	for i:=1; i <= height; i++ {
-		filename := "block_" + strconv.Itoa(i) + ".blk"
-		blockString, _ := LoadBlock(filename)
+		blockString, _ := LoadBlock(i)
 		block := DeserialiseBlock(blockString)
-		valid, invalidReason := VerifyBlock(block, prevBlock)
+		valid, invalidReason := verifyBlockHeader(block, prevBlock)
+		if valid {
+			valid, invalidReason = state.ConnectBlock(block)
+		}
 		if valid {
 			prevBlock = block
 		} else {
@@ -170,11 +363,11 @@ func GetHighestNodeBlockHeight(nodeList []string) (string, int) {
     highest := 0
     bestNode := ""
 
-    for _, port := range nodeList {
-        height := GetNetworkBlockHeight(port)
+    for _, address := range nodeList {
+        height := GetNetworkBlockHeight(address)
         if height >  highest {
             highest = height
-            bestNode = port
+            bestNode = address
         }
     }
 
@@ -182,11 +375,11 @@ func GetHighestNodeBlockHeight(nodeList []string) (string, int) {
 }
 
 
-func GetNetworkBlockHeight(port string) int {
+func GetNetworkBlockHeight(address string) int {
     reqHeader := netpack.ConstructRequestHeader("generic", "BlockHeight")
     packet := netpack.ConstructNetworkPacket(reqHeader, "")
     packetString, _ := Serialise(packet)
-    success, response := netpack.BroadcastDuplexPacket(packetString, port)
+    success, response := netpack.BroadcastDuplexPacket(packetString, address)
 
     if success {
         networkHeight, _ := strconv.Atoi(response.Body)
@@ -195,55 +388,3 @@ func GetNetworkBlockHeight(port string) int {
         return -1
     }
 }
-
-
-func SyncNodeBlockchain(blockHeight int, heightDiff int, port string) bool {
-    prevBlock := GetHighestBlock()
-
-    // establish connection with node
-    conn, err := net.Dial("tcp", "localhost:"+port)
-    if err != nil {
-        fmt.Println("Unable to establish a connection with the specified node")
-        return false
-    }
-
-    // create blockchain sync initialisation packet
-    reqHeader := netpack.ConstructRequestHeader("generic", "SyncBlockchain")
-    packet := netpack.ConstructNetworkPacket(reqHeader, strconv.Itoa(blockHeight))
-    packetString, _ := Serialise(packet)
-
-    // send blockchain sync initialisation request
-    fmt.Fprintf(conn, packetString + "\n")
-
-    // check if node can start the syncing routine
-    recv, _ := bufio.NewReader(conn).ReadString('\n')
-    if recv[:len(recv)-1] != "Okay" {
-        fmt.Println("Node unable to start syncing routine")
-        return false
-    }
-
-    // begin syncing the blockchain
-    for i:=0; i < heightDiff; i++ {
-        blockStringRaw, _ := bufio.NewReader(conn).ReadString('\n')
-        blockString := blockStringRaw[:len(blockStringRaw)-1]
-        block := DeserialiseBlock(blockString)
-
-        blockValid, invalidReason := VerifyBlock(block, prevBlock)
-
-        if blockValid {
-            blockId := strconv.Itoa((blockHeight+i)+1)
-            Update(blockString, blockId)
-            prevBlock = block   
-        } else {
-            fmt.Printf("Block %d from network invalid!\n", (blockHeight+i))
-            fmt.Println("Invalid reason: ", invalidReason)
-            return false
-        }
-
-        fmt.Fprintf(conn, "Okay\n")
-    }
-
-    conn.Close()
-
-    return true
-}
\ No newline at end of file
@@ -0,0 +1,436 @@
+package blockchain
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"pocketcoin/coin"
+	"pocketcoin/fileutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+// ---- Block Storage ----
+// the main chain is stored in one append-only block file (blocks.dat), each block is its json followed by a newline
+// the index file (blocks.idx) has a line for each block with its hash, where it is in the block file and the ids of its transactions
+// the index is loaded into memory when the store is opened so lookups by height, block hash or transaction id don't scan the blockchain
+// folders using the old layout of one block_N.blk file per block are imported into the block file the first time they're opened
+// a store opened read only never writes to its folder, so tools can read the folder of a running node
+
+
+const blockFilename = "blocks.dat"
+const indexFilename = "blocks.idx"
+
+var ErrBlockNotFound = errors.New("block not found")
+var ErrReadOnly = errors.New("block store is read only")
+
+
+type BlockStore interface {
+	Height() int  // height of the highest block, -1 if the store is empty
+	LoadBlock(height int) (string, error)  // serialised block at the given height
+	BlockHash(height int) (string, bool)
+	HeightOfHash(blockHash string) (int, bool)
+	FindTransaction(txId string) (TxLocation, bool)
+	Append(block coin.Block) error  // adds the block on top of the highest block
+	Truncate(height int) error  // removes every block above the given height
+	Close() error
+}
+
+
+// where a transaction is stored in the main chain
+type TxLocation struct {
+	Height int
+	Index int  // position in the block body
+}
+
+
+type storeEntry struct {
+	Hash string
+	Offset int64
+	Size int64
+	TxIds []string
+}
+
+
+type fileBlockStore struct {
+	lock sync.Mutex
+	folder string
+	blockFile *os.File
+	entries []storeEntry  // by height
+	heights map[string]int  // block hash -> height
+	transactions map[string]TxLocation
+	readOnly bool
+}
+
+
+// OpenBlockStore opens the block store in the folder, creating it or importing old block files if needed
+func OpenBlockStore(folder string) (BlockStore, error) {
+	store := &fileBlockStore{folder: folder}
+	store.heights = make(map[string]int)
+	store.transactions = make(map[string]TxLocation)
+
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	_, statErr := os.Stat(folder + "/" + blockFilename)
+	newStore := os.IsNotExist(statErr)
+
+	store.blockFile, err = os.OpenFile(folder + "/" + blockFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	interrupted := updateInterrupted(folder)
+	if newStore {
+		err = store.importLegacyBlocks()
+	} else if interrupted {
+		fmt.Println("Last blockchain update was interrupted, rebuilding the block index...")
+		err = store.rebuildIndex()
+	} else {
+		err = store.loadIndex()
+	}
+	if err != nil {
+		store.blockFile.Close()
+		return nil, err
+	}
+
+	if interrupted {
+		os.Remove(folder + "/" + updateMarkerFilename)
+	}
+
+	return store, nil
+}
+
+
+// OpenBlockStoreReadOnly opens an existing block store without writing to the folder
+// if the index doesn't match the block file it's rebuilt in memory, anything after the last complete block is ignored
+func OpenBlockStoreReadOnly(folder string) (BlockStore, error) {
+	store := &fileBlockStore{folder: folder, readOnly: true}
+	store.heights = make(map[string]int)
+	store.transactions = make(map[string]TxLocation)
+
+	var err error
+	store.blockFile, err = os.Open(folder + "/" + blockFilename)
+	if os.IsNotExist(err) {
+		return nil, errors.New("no " + blockFilename + " in " + folder + ", old block files are imported when a node opens the folder")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if updateInterrupted(folder) {
+		_, err = store.scanBlockFile()
+	} else {
+		err = store.loadIndex()
+	}
+	if err != nil {
+		store.blockFile.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+
+// reads the index file, the index is rebuilt from the block file if it doesn't match
+func (store *fileBlockStore) loadIndex() error {
+	indexFile, err := os.Open(store.folder + "/" + indexFilename)
+	if err == nil {
+		scanner := bufio.NewScanner(indexFile)
+		scanner.Buffer(nil, 1 << 26)
+		for scanner.Scan() {
+			entry := storeEntry{}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				break
+			}
+			store.addEntry(entry)
+		}
+		indexFile.Close()
+	}
+
+	info, err := store.blockFile.Stat()
+	if err != nil {
+		return err
+	}
+	if store.endOffset() == info.Size() {
+		return nil
+	}
+
+	if store.readOnly {
+		_, err = store.scanBlockFile()
+		return err
+	}
+	return store.rebuildIndex()
+}
+
+
+// rebuildIndex reads every block in the block file and rewrites the index
+func (store *fileBlockStore) rebuildIndex() error {
+	offset, err := store.scanBlockFile()
+	if err != nil {
+		return err
+	}
+
+	// anything after the last complete block is dropped
+	err = store.blockFile.Truncate(offset)
+	if err == nil {
+		err = store.blockFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	return store.writeIndex()
+}
+
+
+// builds the index in memory from the block file, returns the end of the last complete block
+func (store *fileBlockStore) scanBlockFile() (int64, error) {
+	store.entries = nil
+	store.heights = make(map[string]int)
+	store.transactions = make(map[string]TxLocation)
+
+	_, err := store.blockFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(store.blockFile)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		block := DeserialiseBlock(string(line))
+		store.addEntry(newStoreEntry(block, offset, int64(len(line))))
+		offset += int64(len(line))
+	}
+
+	return offset, nil
+}
+
+
+func (store *fileBlockStore) importLegacyBlocks() error {
+	for i:=0; ; i++ {
+		data, err := ioutil.ReadFile(store.folder + "/block_" + strconv.Itoa(i) + ".blk")
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		err = store.append(DeserialiseBlock(string(data)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(store.entries) > 0 {
+		fmt.Printf("Imported %d block files into %s\n", len(store.entries), blockFilename)
+	}
+	return nil
+}
+
+
+func newStoreEntry(block coin.Block, offset int64, size int64) storeEntry {
+	entry := storeEntry{}
+	entry.Hash = block.Hash
+	entry.Offset = offset
+	entry.Size = size
+	entry.TxIds = TransactionHashes(block.Body)
+	return entry
+}
+
+
+func (store *fileBlockStore) addEntry(entry storeEntry) {
+	height := len(store.entries)
+	store.entries = append(store.entries, entry)
+	store.heights[entry.Hash] = height
+	for i, txId := range entry.TxIds {
+		store.transactions[txId] = TxLocation{Height: height, Index: i}
+	}
+}
+
+
+func (store *fileBlockStore) removeEntry() {
+	height := len(store.entries) - 1
+	entry := store.entries[height]
+	store.entries = store.entries[:height]
+
+	delete(store.heights, entry.Hash)
+	for _, txId := range entry.TxIds {
+		if location, found := store.transactions[txId]; found && location.Height == height {
+			delete(store.transactions, txId)
+		}
+	}
+}
+
+
+func (store *fileBlockStore) endOffset() int64 {
+	if len(store.entries) == 0 {
+		return 0
+	}
+	last := store.entries[len(store.entries)-1]
+	return last.Offset + last.Size
+}
+
+
+func (store *fileBlockStore) writeIndex() error {
+	var index strings.Builder
+	for _, entry := range store.entries {
+		entryString, _ := Serialise(entry)
+		index.WriteString(entryString + "\n")
+	}
+	return fileutil.AtomicWriteFile(store.folder + "/" + indexFilename, []byte(index.String()), 0644)
+}
+
+
+func (store *fileBlockStore) Height() int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return len(store.entries) - 1
+}
+
+
+func (store *fileBlockStore) LoadBlock(height int) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if height < 0 || height >= len(store.entries) {
+		return "", ErrBlockNotFound
+	}
+	entry := store.entries[height]
+
+	data := make([]byte, entry.Size)
+	_, err := store.blockFile.ReadAt(data, entry.Offset)
+	if err != nil {
+		return "", err
+	}
+
+	// remove the newline
+	return string(data[:len(data)-1]), nil
+}
+
+
+func (store *fileBlockStore) BlockHash(height int) (string, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if height < 0 || height >= len(store.entries) {
+		return "", false
+	}
+	return store.entries[height].Hash, true
+}
+
+
+func (store *fileBlockStore) HeightOfHash(blockHash string) (int, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	height, found := store.heights[blockHash]
+	return height, found
+}
+
+
+func (store *fileBlockStore) FindTransaction(txId string) (TxLocation, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	location, found := store.transactions[txId]
+	return location, found
+}
+
+
+func (store *fileBlockStore) Append(block coin.Block) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	return store.append(block)
+}
+
+
+func (store *fileBlockStore) append(block coin.Block) error {
+	serialisedBlock, err := Serialise(block)
+	if err != nil {
+		return err
+	}
+	data := []byte(serialisedBlock + "\n")
+
+	offset := store.endOffset()
+	_, err = store.blockFile.WriteAt(data, offset)
+	if err == nil {
+		err = store.blockFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	entry := newStoreEntry(block, offset, int64(len(data)))
+	entryString, _ := Serialise(entry)
+	indexFile, err := os.OpenFile(store.folder + "/" + indexFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	_, err = indexFile.WriteString(entryString + "\n")
+	if err == nil {
+		err = indexFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	store.addEntry(entry)
+	return nil
+}
+
+
+func (store *fileBlockStore) Truncate(height int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if height < -1 || height >= len(store.entries) {
+		return nil
+	}
+
+	for len(store.entries) - 1 > height {
+		store.removeEntry()
+	}
+
+	err := store.blockFile.Truncate(store.endOffset())
+	if err == nil {
+		err = store.blockFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	return store.writeIndex()
+}
+
+
+func (store *fileBlockStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.blockFile.Close()
+}
@@ -0,0 +1,324 @@
+package blockchain
+
+import (
+	"pocketcoin/coin"
+	"strconv"
+)
+
+
+// ---- Chain State ----
+// the account balances, account nonces, wallet public keys and unspent outputs after applying every block up to a point in the chain
+// the transactions in a block are validated against the chain state of its previous block
+// so blocks containing unsigned transfers, overspends, double spends or replayed transactions are rejected
+
+
+const CoinbaseAddress = "coinbase"  // FromAddress of the coinbase transaction
+
+
+type ChainState struct {
+	Height int  // height of the last block applied, -1 before the genesis block
+	Balances map[string]int64
+	Nonces map[string]int  // wallet address -> nonce of the next transaction drawn from the account
+	PublicKeys map[string]string  // wallet address -> pgp public key pem
+	PublicKeyHeights map[string]int  // wallet address -> height of the block that first included its public key
+	UTXOs UTXOSet
+}
+
+
+func NewChainState() *ChainState {
+	state := &ChainState{}
+	state.Height = -1
+	state.Balances = make(map[string]int64)
+	state.Nonces = make(map[string]int)
+	state.PublicKeys = make(map[string]string)
+	state.PublicKeyHeights = make(map[string]int)
+	state.UTXOs = UTXOSet{}
+	return state
+}
+
+
+func (state *ChainState) Copy() *ChainState {
+	stateCopy := NewChainState()
+	stateCopy.Height = state.Height
+	for address, balance := range state.Balances {
+		stateCopy.Balances[address] = balance
+	}
+	for address, nonce := range state.Nonces {
+		stateCopy.Nonces[address] = nonce
+	}
+	for address, publicKeyPem := range state.PublicKeys {
+		stateCopy.PublicKeys[address] = publicKeyPem
+	}
+	for address, height := range state.PublicKeyHeights {
+		stateCopy.PublicKeyHeights[address] = height
+	}
+	for key, output := range state.UTXOs {
+		stateCopy.UTXOs[key] = output
+	}
+	return stateCopy
+}
+
+
+func IsCoinbase(tx coin.Transaction) bool {
+	return tx.FromAddress == CoinbaseAddress
+}
+
+
+// SpendsFromAccount reports whether the transaction draws from the senders account balance
+// these transactions are signed by the sender and must carry the senders next nonce
+// UTXO transactions that only spend outputs can't be replayed as their inputs are spent
+func SpendsFromAccount(tx coin.Transaction) bool {
+	if IsCoinbase(tx) {
+		return false
+	}
+	return !IsUTXOTransaction(tx) || tx.Amount > 0
+}
+
+
+// ChainStateAt builds the chain state after the given block, the block can be on the main chain or a side branch
+func ChainStateAt(block coin.Block) (*ChainState, bool) {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return chainStateAt(block)
+}
+
+
+func chainStateAt(block coin.Block) (*ChainState, bool) {
+	// the state after the highest block is kept up to date so doesn't need rebuilding
+	if tipState != nil && tipState.Height == blockStore.Height() {
+		if height, found := blockStore.HeightOfHash(block.Hash); found && height == tipState.Height {
+			return tipState.Copy(), true
+		}
+	}
+
+	state := NewChainState()
+
+	// side branch blocks are kept in the block index, main chain blocks are loaded from the block store
+	var branch []coin.Block
+	height, _ := strconv.Atoi(block.Header.BlockId)
+	if node, indexed := blockIndex[block.Hash]; indexed {
+		for node != nil && !node.inMainChain() {
+			branch = append([]coin.Block{node.block()}, branch...)
+			node = node.Parent
+		}
+		if node == nil {
+			return state, false
+		}
+		height = node.Height
+	}
+
+	// blocks are only unindexed when checking the blockchain at startup or syncing
+	lastHash := ""
+	for i:=0; i <= height; i++ {
+		blockString, err := LoadBlock(i)
+		if err != nil {
+			return state, false
+		}
+		mainBlock := DeserialiseBlock(blockString)
+		state.ApplyBlock(mainBlock)
+		lastHash = mainBlock.Hash
+	}
+	if len(branch) == 0 && lastHash != block.Hash {
+		return state, false
+	}
+
+	for _, sideBlock := range branch {
+		state.ApplyBlock(sideBlock)
+	}
+
+	return state, true
+}
+
+
+func (state *ChainState) ApplyBlock(block coin.Block) {
+	state.Height, _ = strconv.Atoi(block.Header.BlockId)
+	for _, tx := range block.Body {
+		state.ApplyTransaction(tx)
+	}
+}
+
+
+func (state *ChainState) ApplyTransaction(tx coin.Transaction) {
+	_, keyKnown := state.PublicKeys[tx.FromAddress]
+	if !keyKnown && tx.PublicKey != "" && SHA256([]byte(tx.PublicKey))[:32] == tx.FromAddress {
+		state.PublicKeys[tx.FromAddress] = tx.PublicKey
+		state.PublicKeyHeights[tx.FromAddress] = state.Height
+	}
+
+	if !IsCoinbase(tx) && tx.FromAddress != "" {
+		state.Balances[tx.FromAddress] -= AccountDebit(tx)
+	}
+	if SpendsFromAccount(tx) {
+		state.Nonces[tx.FromAddress]++
+	}
+	if tx.ToAddress != "" {
+		state.Balances[tx.ToAddress] += tx.Amount
+	}
+
+	state.UTXOs.ApplyTransaction(tx)
+}
+
+
+// publicKeyLookup finds public keys in the transaction or the chain state
+func (state *ChainState) publicKeyLookup(tx coin.Transaction) func(string) (string, bool) {
+	return func(walletAddress string) (string, bool) {
+		if walletAddress == tx.FromAddress && tx.PublicKey != "" {
+			return tx.PublicKey, true
+		}
+		publicKeyPem, found := state.PublicKeys[walletAddress]
+		return publicKeyPem, found
+	}
+}
+
+
+// ValidTransaction checks a non coinbase transaction is signed by the sender and only spends what the sender owns
+func (state *ChainState) ValidTransaction(tx coin.Transaction) (bool, string) {
+	if IsCoinbase(tx) {
+		return false, "Coinbase transaction must be the first transaction in the block"
+	}
+
+	publicKeyLookup := state.publicKeyLookup(tx)
+	balance := state.Balances[tx.FromAddress]
+
+	if SpendsFromAccount(tx) && tx.Nonce != state.Nonces[tx.FromAddress] {
+		return false, "Transaction nonce invalid, expected " + strconv.Itoa(state.Nonces[tx.FromAddress])
+	}
+
+	if IsUTXOTransaction(tx) {
+		valid, invalidReason := state.UTXOs.ValidTransaction(tx, publicKeyLookup)
+		if !valid {
+			return false, invalidReason
+		}
+		if tx.Amount > balance {
+			return false, "Sender balance too low"
+		}
+		return true, ""
+	}
+
+	if tx.Amount <= 0 || tx.Fee < 0 {
+		return false, "Transaction amount invalid"
+	}
+	if tx.FromAddress == tx.ToAddress {
+		return false, "Transaction sends to the senders own address"
+	}
+	if tx.Fee > balance || tx.Amount > balance - tx.Fee {
+		return false, "Sender balance too low"
+	}
+
+	publicKeyPem, found := publicKeyLookup(tx.FromAddress)
+	if !found || SHA256([]byte(publicKeyPem))[:32] != tx.FromAddress {
+		return false, "Sender public key unknown"
+	}
+	if !SignatureValid(SigningString(tx), tx.Signature, publicKeyPem) {
+		return false, "Sender signature invalid"
+	}
+
+	return true, ""
+}
+
+
+// ConnectTransaction applies the transaction to the chain state if it's valid
+func (state *ChainState) ConnectTransaction(tx coin.Transaction) (bool, string) {
+	valid, invalidReason := state.ValidTransaction(tx)
+	if valid {
+		state.ApplyTransaction(tx)
+	}
+	return valid, invalidReason
+}
+
+
+// UndoBlock removes the last block applied from the chain state
+// spentOutput looks up the outputs spent by the blocks UTXO transactions so they can be made unspent again
+func (state *ChainState) UndoBlock(block coin.Block, spentOutput func(string, int) (coin.TxOutput, bool)) {
+	height, _ := strconv.Atoi(block.Header.BlockId)
+
+	for i := len(block.Body) - 1; i >= 0; i-- {
+		tx := block.Body[i]
+
+		if !IsCoinbase(tx) && tx.FromAddress != "" {
+			state.addBalance(tx.FromAddress, AccountDebit(tx))
+		}
+		if SpendsFromAccount(tx) {
+			state.Nonces[tx.FromAddress]--
+			if state.Nonces[tx.FromAddress] == 0 {
+				delete(state.Nonces, tx.FromAddress)
+			}
+		}
+		if tx.ToAddress != "" {
+			state.addBalance(tx.ToAddress, -tx.Amount)
+		}
+
+		if keyHeight, found := state.PublicKeyHeights[tx.FromAddress]; found && keyHeight == height {
+			delete(state.PublicKeys, tx.FromAddress)
+			delete(state.PublicKeyHeights, tx.FromAddress)
+		}
+
+		if IsUTXOTransaction(tx) {
+			txId := TransactionHash(tx)
+			for outputIndex := range tx.Outputs {
+				delete(state.UTXOs, outPointKey(txId, outputIndex))
+			}
+			for _, input := range tx.Inputs {
+				if output, found := spentOutput(input.PrevTxId, input.OutputIndex); found {
+					state.UTXOs[outPointKey(input.PrevTxId, input.OutputIndex)] = output
+				}
+			}
+		}
+	}
+
+	state.Height = height - 1
+}
+
+
+// balances that return to zero are removed so the state matches one built from scratch
+func (state *ChainState) addBalance(address string, amount int64) {
+	state.Balances[address] += amount
+	if state.Balances[address] == 0 {
+		delete(state.Balances, address)
+	}
+}
+
+
+// ConnectBlock checks every transaction in the block body in order and applies it to the chain state
+// the state is only left after the block if the block is valid
+func (state *ChainState) ConnectBlock(block coin.Block) (bool, string) {
+	state.Height, _ = strconv.Atoi(block.Header.BlockId)
+	if len(block.Body) == 0 || !IsCoinbase(block.Body[0]) {
+		return false, "Block has no coinbase transaction"
+	}
+	if len(block.Body) - 1 > MaxBlockTransactions {
+		return false, "Block has too many transactions"
+	}
+
+	coinbase := block.Body[0]
+	if IsUTXOTransaction(coinbase) || coinbase.Fee != 0 || coinbase.Amount < 0 {
+		return false, "Coinbase transaction invalid"
+	}
+
+	included := make(map[string]bool)
+	maxCoinbase := BlockReward
+	for i, tx := range block.Body[1:] {
+		txHash := TransactionHash(tx)
+		if included[txHash] {
+			return false, "Transaction included twice"
+		}
+		included[txHash] = true
+
+		valid, invalidReason := state.ConnectTransaction(tx)
+		if !valid {
+			return false, "Transaction " + strconv.Itoa(i+1) + " invalid: " + invalidReason
+		}
+		if maxCoinbase, valid = addAmounts(maxCoinbase, tx.Fee); !valid {
+			return false, "Transaction fees too large"
+		}
+	}
+
+	// the coinbase claims no more than the block reward plus the fees of the valid transactions
+	if coinbase.Amount > maxCoinbase {
+		return false, "Coinbase transaction amount invalid"
+	}
+	state.ApplyTransaction(coinbase)
+
+	return true, ""
+}
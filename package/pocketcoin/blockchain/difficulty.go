@@ -0,0 +1,192 @@
+package blockchain
+
+import (
+	"pocketcoin/coin"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// ---- Difficulty Retargeting ----
+// targets are stored in block headers using the compact "bits" encoding from bitcoin
+// the first byte is the length of the target in bytes, the other 3 bytes are the most significant bytes of the target
+// every RetargetInterval blocks the target is scaled by how long the last interval actually took
+// compared to how long it should have taken at the target block time
+// blocks in between must use the same target as their previous block
+
+
+const RetargetInterval = 10
+const maxFutureBlockTime = 2 * time.Hour
+
+var MaxTarget = new(big.Int).Lsh(big.NewInt(1), 240)  // easiest target allowed
+var MaxTargetBits = BigToCompact(MaxTarget)
+var targetBlockTime = defaultBlockTime * time.Second  // set by LoadNetworkParams, every node on a network retargets the same way
+
+
+// ParseTimestamp parses timestamps created with time.Now().String()
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	// remove the monotonic clock reading
+	if i := strings.Index(timestamp, " m="); i != -1 {
+		timestamp = timestamp[:i]
+	}
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", timestamp)
+}
+
+
+// returns the header of the blocks ancestor at the given height, the caller holds chainLock
+func ancestorHeader(block coin.Block, height int) (coin.BlockHeader, bool) {
+	if node, indexed := blockIndex[block.Hash]; indexed {
+		for node != nil && node.Height > height {
+			node = node.Parent
+		}
+		if node == nil || node.Height != height {
+			return coin.BlockHeader{}, false
+		}
+		return node.Header, true
+	}
+
+	// blocks are only unindexed when checking the blockchain at startup
+	blockString, err := LoadBlock(height)
+	if err != nil {
+		return coin.BlockHeader{}, false
+	}
+	return DeserialiseBlock(blockString).Header, true
+}
+
+
+// CompactToBig decodes a compact target, negative targets are decoded as negative numbers
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8 * (3 - exponent))
+	} else {
+		target.Lsh(target, 8 * (exponent - 3))
+	}
+
+	if compact & 0x00800000 != 0 {
+		target.Neg(target)
+	}
+	return target
+}
+
+
+// BigToCompact encodes a target, precision past the 3 most significant bytes is lost
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	absTarget := new(big.Int).Abs(target)
+	exponent := uint(len(absTarget.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(absTarget.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(absTarget.Rsh(absTarget, 8 * (exponent - 3)).Uint64())
+	}
+
+	// the sign bit is part of the mantissa so shift it out if it's set
+	if mantissa & 0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent << 24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+
+// NextTarget returns the compact target the block after prevBlock has to be mined with
+// it reads the block index so takes chainLock, blocks can be processed by other goroutines meanwhile
+func NextTarget(prevBlock coin.Block) uint32 {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return blockTarget(prevBlock)
+}
+
+
+// NextTarget for callers already holding chainLock
+func blockTarget(prevBlock coin.Block) uint32 {
+	return nextTarget(prevBlock.Header, func(height int) (coin.BlockHeader, bool) {
+		return ancestorHeader(prevBlock, height)
+	})
+}
+
+
+// nextTarget works out the target from the previous header, ancestor returns the header at a lower height in the same chain
+func nextTarget(prevHeader coin.BlockHeader, ancestor func(int) (coin.BlockHeader, bool)) uint32 {
+	prevHeight, _ := strconv.Atoi(prevHeader.BlockId)
+	height := prevHeight + 1
+	prevTarget := prevHeader.TargetBits
+
+	if height % RetargetInterval != 0 {
+		return prevTarget
+	}
+
+	firstHeader, found := ancestor(height - RetargetInterval)
+	if !found {
+		return prevTarget
+	}
+	firstTime, err1 := ParseTimestamp(firstHeader.Timestamp)
+	lastTime, err2 := ParseTimestamp(prevHeader.Timestamp)
+	if err1 != nil || err2 != nil {
+		return prevTarget
+	}
+
+	// limit the adjustment to a factor of 4 either way
+	expectedTimespan := targetBlockTime * (RetargetInterval - 1)
+	actualTimespan := lastTime.Sub(firstTime)
+	if actualTimespan < expectedTimespan / 4 {
+		actualTimespan = expectedTimespan / 4
+	} else if actualTimespan > expectedTimespan * 4 {
+		actualTimespan = expectedTimespan * 4
+	}
+
+	newTarget := CompactToBig(prevTarget)
+	newTarget.Mul(newTarget, big.NewInt(int64(actualTimespan)))
+	newTarget.Div(newTarget, big.NewInt(int64(expectedTimespan)))
+	if newTarget.Cmp(MaxTarget) > 0 {
+		newTarget = MaxTarget
+	}
+
+	return BigToCompact(newTarget)
+}
+
+
+// HashMeetsTarget checks the hash is below the target, targets that are negative, zero or easier than MaxTarget are never met
+func HashMeetsTarget(blockHash string, bits uint32) bool {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 || target.Cmp(MaxTarget) > 0 {
+		return false
+	}
+
+	hashInt, success := new(big.Int).SetString(blockHash, 16)
+	if !success || len(blockHash) != 64 {
+		return false
+	}
+
+	return hashInt.Cmp(target) == -1
+}
+
+
+func timestampValid(header coin.BlockHeader, prevHeader coin.BlockHeader) bool {
+	blockTime, err := ParseTimestamp(header.Timestamp)
+	if err != nil {
+		return false
+	}
+	prevBlockTime, err := ParseTimestamp(prevHeader.Timestamp)
+	if err != nil {
+		return false
+	}
+
+	return !blockTime.Before(prevBlockTime) && blockTime.Before(time.Now().Add(maxFutureBlockTime))
+}
@@ -0,0 +1,325 @@
+package blockchain
+
+import (
+	"pocketcoin/coin"
+	"math/big"
+	"sync"
+)
+
+
+// ---- Fork Handling ----
+// every block the node knows about is kept in a block index, including blocks on side branches
+// each entry stores the cumulative proof of work from the genesis block up to that block
+// the main chain (the blocks in the block store) always follows the branch with the most work
+// if a side branch gets more work than the main chain the blockchain is reorganised onto it
+
+
+type blockNode struct {
+	Hash string
+	Header coin.BlockHeader
+	Height int
+	Work *big.Int  // cumulative work up to and including this block
+	Parent *blockNode
+	Body []coin.Transaction  // only kept for side branch blocks, main chain bodies are in the block store
+}
+
+
+// Blocks added to and removed from the main chain by a new block
+type ChainUpdate struct {
+	Connected []coin.Block  // lowest block first
+	Disconnected []coin.Block  // highest block first
+}
+
+
+const KnownBlockReason = "Block already known"
+
+var blockIndex = make(map[string]*blockNode)
+var mainChain []*blockNode
+var chainLock sync.Mutex
+
+
+// BlockWork returns the expected number of hashes needed to mine a block with the headers target
+func BlockWork(header coin.BlockHeader) *big.Int {
+	target := CompactToBig(header.TargetBits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	// work = 2^256 / (target + 1)
+	maxHash := new(big.Int).Lsh(big.NewInt(1), 256)
+	return maxHash.Div(maxHash, target.Add(target, big.NewInt(1)))
+}
+
+
+// LoadBlockIndex builds the block index from the block store, needs to be called before ProcessBlock
+func LoadBlockIndex() {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	loadBlockIndex()
+}
+
+
+func loadBlockIndex() {
+	blockIndex = make(map[string]*blockNode)
+	mainChain = nil
+	height := Height()
+
+	var parent *blockNode
+	for i:=0; i <= height; i++ {
+		blockString, _ := LoadBlock(i)
+		block := DeserialiseBlock(blockString)
+		node := newBlockNode(block, parent)
+		node.Body = nil
+
+		blockIndex[node.Hash] = node
+		mainChain = append(mainChain, node)
+		parent = node
+	}
+}
+
+
+func newBlockNode(block coin.Block, parent *blockNode) *blockNode {
+	node := &blockNode{}
+	node.Hash = block.Hash
+	node.Header = block.Header
+	node.Body = block.Body
+	node.Parent = parent
+	node.Work = BlockWork(block.Header)
+
+	if parent != nil {
+		node.Height = parent.Height + 1
+		node.Work.Add(node.Work, parent.Work)
+	}
+
+	return node
+}
+
+
+func (node *blockNode) inMainChain() bool {
+	return node.Height < len(mainChain) && mainChain[node.Height] == node
+}
+
+
+func (node *blockNode) block() coin.Block {
+	return coin.Block{Hash: node.Hash, Header: node.Header, Body: node.Body}
+}
+
+
+func chainTip() *blockNode {
+	return mainChain[len(mainChain)-1]
+}
+
+
+// ChainWork returns the cumulative work of the main chain
+func ChainWork() *big.Int {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	if len(mainChain) == 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(chainTip().Work)
+}
+
+
+func BlockKnown(blockHash string) bool {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	_, known := blockIndex[blockHash]
+	return known
+}
+
+
+// ProcessBlock verifies a new block and adds it to the block index
+// the block either extends the main chain, is kept on a side branch, or causes a reorganisation onto its branch
+// blocks with an unknown previous block are added to the orphan pool and OrphanBlockReason is returned
+func ProcessBlock(block coin.Block) (ChainUpdate, bool, string) {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	update, accepted, reason := processBlock(block)
+	if !accepted {
+		return update, accepted, reason
+	}
+
+	// connect any orphans that were waiting on this block
+	waiting := takeOrphanChildren(block.Hash)
+	for len(waiting) > 0 {
+		orphan := waiting[0]
+		waiting = waiting[1:]
+
+		orphanUpdate, orphanAccepted, _ := processBlock(orphan)
+		if orphanAccepted {
+			update = mergeChainUpdates(update, orphanUpdate)
+			waiting = append(waiting, takeOrphanChildren(orphan.Hash)...)
+		}
+	}
+
+	return update, accepted, reason
+}
+
+
+func processBlock(block coin.Block) (ChainUpdate, bool, string) {
+	update := ChainUpdate{}
+
+	if _, known := blockIndex[block.Hash]; known {
+		return update, false, KnownBlockReason
+	}
+
+	if block.Header.PrevBlockHash == genesisPrevBlockHash {
+		return update, false, "Block is the genesis block of another network"
+	}
+
+	parent, parentKnown := blockIndex[block.Header.PrevBlockHash]
+	if !parentKnown {
+		// only the block's own hash and proof of work can be checked without its parent
+		if block.Hash != HeaderHash(block.Header) {
+			return update, false, "Block hash invalid"
+		}
+		if !HashMeetsTarget(block.Hash, block.Header.TargetBits) {
+			return update, false, "Block hash does not meet target"
+		}
+		addOrphanBlock(block)
+		return update, false, OrphanBlockReason
+	}
+
+	blockValid, invalidReason := VerifyBlock(block, parent.block())
+	if !blockValid {
+		return update, false, invalidReason
+	}
+
+	node := newBlockNode(block, parent)
+	tip := chainTip()
+
+	// the block is only indexed once it's connected so a block that fails to connect can be fetched again
+	if parent == tip {
+		err := beginUpdate()
+		if err != nil {
+			return update, false, err.Error()
+		}
+		err = connectBlock(node)
+		if err != nil {
+			abortUpdate(parent.Height)
+			return update, false, err.Error()
+		}
+		blockIndex[node.Hash] = node
+		update.Connected = append(update.Connected, block)
+		return update, true, errorReason(endUpdate())
+	}
+
+	blockIndex[node.Hash] = node
+
+	if node.Work.Cmp(tip.Work) <= 0 {
+		return update, true, "Block added to a side branch"
+	}
+
+	// the side branch now has the most work, reorganise onto it
+	var branch []*blockNode
+	forkPoint := node
+	for !forkPoint.inMainChain() {
+		branch = append([]*blockNode{forkPoint}, branch...)
+		forkPoint = forkPoint.Parent
+	}
+
+	var oldBranch []*blockNode
+	for i := len(mainChain) - 1; i > forkPoint.Height; i-- {
+		disconnected := mainChain[i]
+		blockString, err := LoadBlock(i)
+		if err != nil {
+			return update, false, err.Error()
+		}
+		disconnected.Body = DeserialiseBlock(blockString).Body
+		update.Disconnected = append(update.Disconnected, disconnected.block())
+		oldBranch = append([]*blockNode{disconnected}, oldBranch...)
+	}
+
+	for _, connected := range branch {
+		update.Connected = append(update.Connected, connected.block())
+	}
+
+	err := beginUpdate()
+	if err != nil {
+		return update, false, err.Error()
+	}
+
+	for _, disconnected := range update.Disconnected {
+		disconnectTipState(disconnected)
+	}
+
+	// remove blocks above the fork point from the block store then add the new branch
+	err = blockStore.Truncate(forkPoint.Height)
+	if err == nil {
+		mainChain = mainChain[:forkPoint.Height+1]
+		for _, connected := range branch {
+			err = connectBlock(connected)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// connectBlock drops the bodies of the blocks it adds, the new branch is a side branch again
+		for i, connected := range branch {
+			connected.Body = update.Connected[i].Body
+		}
+		restoreMainChain(forkPoint, oldBranch)
+		delete(blockIndex, node.Hash)
+		return ChainUpdate{}, false, err.Error()
+	}
+
+	return update, true, errorReason(endUpdate())
+}
+
+
+// puts the old branch back after a reorganisation failed partway so the block index, tip state and block store agree
+// if that fails too the index and chain state are reloaded from whatever the block store holds,
+// the update marker is left so the block store is checked again the next time it's opened
+func restoreMainChain(forkPoint *blockNode, oldBranch []*blockNode) {
+	err := blockStore.Truncate(forkPoint.Height)
+	if err == nil {
+		mainChain = mainChain[:forkPoint.Height+1]
+		for _, node := range oldBranch {
+			err = blockStore.Append(node.block())
+			if err != nil {
+				break
+			}
+			mainChain = append(mainChain, node)
+			node.Body = nil
+		}
+	}
+
+	if err != nil {
+		loadBlockIndex()
+	} else {
+		endUpdate()
+	}
+
+	// the tip state had the old branch undone and part of the new one applied
+	if tipState != nil {
+		tipState = buildChainState()
+	}
+}
+
+
+func connectBlock(node *blockNode) error {
+	err := blockStore.Append(node.block())
+	if err != nil {
+		return err
+	}
+
+	connectTipState(node.block())
+	mainChain = append(mainChain, node)
+	node.Body = nil
+
+	return nil
+}
+
+
+func errorReason(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
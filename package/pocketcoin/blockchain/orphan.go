@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"pocketcoin/coin"
+)
+
+
+// ---- Orphan Blocks ----
+// blocks whose previous block isn't known yet are held in the orphan pool keyed by their parents hash
+// once the parent is added to the block index the orphans are processed too
+
+
+const OrphanBlockReason = "Orphan block, previous block unknown"
+const MaxOrphanBlocks = 100
+
+
+var orphanBlocks = make(map[string][]coin.Block)  // parent hash -> orphans
+var orphanParents = make(map[string]string)  // orphan hash -> parent hash
+var orphanOrder []string  // orphan hashes, oldest first
+
+
+func addOrphanBlock(block coin.Block) {
+	if _, exists := orphanParents[block.Hash]; exists {
+		return
+	}
+
+	if len(orphanOrder) >= MaxOrphanBlocks {
+		removeOrphanBlock(orphanOrder[0])
+	}
+
+	parentHash := block.Header.PrevBlockHash
+	orphanBlocks[parentHash] = append(orphanBlocks[parentHash], block)
+	orphanParents[block.Hash] = parentHash
+	orphanOrder = append(orphanOrder, block.Hash)
+}
+
+
+func removeOrphanBlock(blockHash string) {
+	parentHash, exists := orphanParents[blockHash]
+	if !exists {
+		return
+	}
+	delete(orphanParents, blockHash)
+
+	siblings := orphanBlocks[parentHash]
+	for i, orphan := range siblings {
+		if orphan.Hash == blockHash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(orphanBlocks, parentHash)
+	} else {
+		orphanBlocks[parentHash] = siblings
+	}
+
+	for i, hash := range orphanOrder {
+		if hash == blockHash {
+			orphanOrder = append(orphanOrder[:i], orphanOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+
+// takes the orphans waiting on the given parent out of the pool
+func takeOrphanChildren(parentHash string) []coin.Block {
+	children := orphanBlocks[parentHash]
+	for _, child := range children {
+		removeOrphanBlock(child.Hash)
+	}
+	return children
+}
+
+
+// OrphanRoot returns the hash of the missing block that the orphan is waiting on
+func OrphanRoot(blockHash string) string {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	// stops on a hash it has already visited in case the orphans form a cycle
+	visited := make(map[string]bool)
+	missingHash := blockHash
+	for !visited[missingHash] {
+		visited[missingHash] = true
+		parentHash, isOrphan := orphanParents[missingHash]
+		if !isOrphan {
+			return missingHash
+		}
+		missingHash = parentHash
+	}
+	return missingHash
+}
+
+
+func OrphanCount() int {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return len(orphanOrder)
+}
+
+
+// GetBlockByHash looks for a block in the main chain or on a side branch
+func GetBlockByHash(blockHash string) (coin.Block, bool) {
+	chainLock.Lock()
+	node, known := blockIndex[blockHash]
+	if !known {
+		chainLock.Unlock()
+		return coin.Block{}, false
+	}
+	sideBlock := node.block()
+	height := node.Height
+	chainLock.Unlock()
+
+	if sideBlock.Body != nil {
+		return sideBlock, true
+	}
+
+	blockString, err := LoadBlock(height)
+	if err != nil {
+		return coin.Block{}, false
+	}
+	block := DeserialiseBlock(blockString)
+
+	return block, block.Hash == blockHash
+}
+
+
+// combines the changes to the main chain from processing two blocks one after the other
+func mergeChainUpdates(first ChainUpdate, second ChainUpdate) ChainUpdate {
+	for _, disconnected := range second.Disconnected {
+		wasConnected := false
+		for i, connected := range first.Connected {
+			if connected.Hash == disconnected.Hash {
+				first.Connected = append(first.Connected[:i], first.Connected[i+1:]...)
+				wasConnected = true
+				break
+			}
+		}
+		if !wasConnected {
+			first.Disconnected = append(first.Disconnected, disconnected)
+		}
+	}
+	first.Connected = append(first.Connected, second.Connected...)
+
+	return first
+}
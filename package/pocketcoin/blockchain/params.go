@@ -0,0 +1,177 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"pocketcoin/coin"
+	"pocketcoin/fileutil"
+	"time"
+)
+
+
+// ---- Network Parameters ----
+// the block reward, block size, block time, genesis block and peer ports of a network are read from a network parameters file
+// every program on the network loads the same file, the genesis block is built from it so is identical on every node
+// the genesis command mines the genesis block and writes its nonce and hash back into the file
+// a blockchain folder whose first block isn't the networks genesis block is rejected
+
+
+const DefaultParamsFile = "network.json"
+const genesisPrevBlockHash = "genesis"
+const defaultBlockTime = 60  // used by parameter files from before BlockTime was added
+
+// defaults until LoadNetworkParams is called
+var BlockVersion = 0.1
+var BlockReward = 10 * coin.Coin
+var MaxBlockTransactions = 10  // not including the coinbase transaction
+
+var networkParams coin.NetworkParams
+var paramsLoaded = false
+
+
+// ReadNetworkParams reads and checks a network parameters file without loading it, the genesis block doesn't need to be mined yet
+func ReadNetworkParams(filename string) (coin.NetworkParams, error) {
+	params := coin.NetworkParams{}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return params, err
+	}
+	err = json.Unmarshal(data, &params)
+	if err != nil {
+		return params, err
+	}
+
+	if params.NetworkName == "" {
+		return params, errors.New("network name missing")
+	}
+	if params.BlockVersion <= 0 {
+		return params, errors.New("block version invalid")
+	}
+	if params.BlockReward < 0 {
+		return params, errors.New("block reward invalid")
+	}
+	if params.MaxBlockTransactions < 1 {
+		return params, errors.New("max block transactions invalid")
+	}
+	if params.BlockTime == 0 {
+		params.BlockTime = defaultBlockTime
+	}
+	if params.BlockTime < 0 {
+		return params, errors.New("block time invalid")
+	}
+	target := CompactToBig(params.GenesisTargetBits)
+	if target.Sign() <= 0 || target.Cmp(MaxTarget) > 0 {
+		return params, errors.New("genesis target invalid")
+	}
+	if _, err := ParseTimestamp(params.GenesisTimestamp); err != nil {
+		return params, errors.New("genesis timestamp invalid")
+	}
+	for _, allocation := range params.Allocations {
+		if allocation.Amount <= 0 || allocation.Address == "" {
+			return params, errors.New("genesis allocation invalid")
+		}
+	}
+
+	return params, nil
+}
+
+
+// LoadNetworkParams reads the network parameters file and uses its values, needs to be called before SetBlockchainFolder
+func LoadNetworkParams(filename string) (coin.NetworkParams, error) {
+	params, err := ReadNetworkParams(filename)
+	if err != nil {
+		return params, err
+	}
+
+	genesis := GenesisBlock(params)
+	if params.GenesisHash == "" {
+		return params, errors.New("network has no genesis block, create one with genesis.go")
+	}
+	if genesis.Hash != params.GenesisHash || !HashMeetsTarget(genesis.Hash, params.GenesisTargetBits) {
+		return params, errors.New("genesis hash does not match the network parameters")
+	}
+
+	BlockVersion = params.BlockVersion
+	BlockReward = params.BlockReward
+	MaxBlockTransactions = params.MaxBlockTransactions
+	targetBlockTime = time.Duration(params.BlockTime) * time.Second
+	networkParams = params
+	paramsLoaded = true
+
+	return params, nil
+}
+
+
+func SaveNetworkParams(filename string, params coin.NetworkParams) error {
+	data, err := json.MarshalIndent(params, "", "\t")
+	if err != nil {
+		return err
+	}
+	return fileutil.AtomicWriteFile(filename, append(data, '\n'), 0644)
+}
+
+
+// GenesisBlock builds the genesis block, it has a coinbase transaction for each allocation
+func GenesisBlock(params coin.NetworkParams) coin.Block {
+	var body []coin.Transaction
+	for _, allocation := range params.Allocations {
+		coinbase := coin.Transaction{}
+		coinbase.FromAddress = CoinbaseAddress
+		coinbase.ToAddress = allocation.Address
+		coinbase.Amount = allocation.Amount
+		coinbase.Timestamp = params.GenesisTimestamp
+		body = append(body, coinbase)
+	}
+	if len(body) == 0 {
+		body = append(body, coin.Transaction{FromAddress: CoinbaseAddress, Timestamp: params.GenesisTimestamp})
+	}
+
+	block := coin.Block{}
+	block.Header.Version = params.BlockVersion
+	block.Header.BlockId = "0"
+	block.Header.PrevBlockHash = genesisPrevBlockHash
+	block.Header.Timestamp = params.GenesisTimestamp
+	block.Header.TargetBits = params.GenesisTargetBits
+	block.Header.Nonce = params.GenesisNonce
+	block.Header.MerkleRoot = MerkleRoot(body)
+	block.Body = body
+	block.Hash = HeaderHash(block.Header)
+
+	return block
+}
+
+
+// GenesisAllocation returns the coins created by the genesis block
+func GenesisAllocation() int64 {
+	total := int64(0)
+	for _, allocation := range networkParams.Allocations {
+		total += allocation.Amount
+	}
+	return total
+}
+
+
+func genesisValid(blockHash string) bool {
+	return !paramsLoaded || blockHash == networkParams.GenesisHash
+}
+
+
+// InitGenesis adds the genesis block to an empty blockchain folder and checks the first block of any other folder is the genesis block
+// needs to be called after SetBlockchainFolder
+func InitGenesis() error {
+	if !paramsLoaded {
+		return errors.New("network parameters not loaded")
+	}
+
+	if blockStore.Height() == -1 {
+		blockString, _ := Serialise(GenesisBlock(networkParams))
+		return Update(blockString, "0")
+	}
+
+	genesisHash, _ := blockStore.BlockHash(0)
+	if !genesisValid(genesisHash) {
+		return errors.New("blockchain was created with a different genesis block than " + networkParams.NetworkName)
+	}
+	return nil
+}
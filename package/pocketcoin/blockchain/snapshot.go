@@ -0,0 +1,248 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"pocketcoin/coin"
+	"pocketcoin/fileutil"
+	"sort"
+	"strings"
+)
+
+
+// ---- Chain State Snapshot ----
+// the chain state after the highest main chain block is kept in memory so balance and nonce lookups don't replay the blockchain
+// it is updated as blocks are connected, and blocks are undone from it when they're disconnected by a reorganisation
+// every snapshotInterval blocks it's saved to the blockchain folder with a checksum, at startup only the blocks
+// added since the snapshot are applied, the state is rebuilt from the genesis block if the snapshot doesn't check out
+
+
+const stateFilename = "chainstate.json"
+const snapshotInterval = 10
+
+var tipState *ChainState  // guarded by chainLock
+
+
+type stateSnapshot struct {
+	TipHash string
+	Checksum string
+	State *ChainState
+}
+
+
+// Checksum hashes the state in a fixed order, zero balances and nonces are skipped
+func (state *ChainState) Checksum() string {
+	var data strings.Builder
+	fmt.Fprintf(&data, "height %d\n", state.Height)
+
+	for _, address := range sortedKeys(state.Balances) {
+		if state.Balances[address] != 0 {
+			fmt.Fprintf(&data, "balance %s %d\n", address, state.Balances[address])
+		}
+	}
+	for _, address := range sortedKeys(state.Nonces) {
+		if state.Nonces[address] != 0 {
+			fmt.Fprintf(&data, "nonce %s %d\n", address, state.Nonces[address])
+		}
+	}
+	for _, address := range sortedKeys(state.PublicKeys) {
+		fmt.Fprintf(&data, "key %s %d %s\n", address, state.PublicKeyHeights[address], SHA256([]byte(state.PublicKeys[address])))
+	}
+	for _, key := range sortedKeys(state.UTXOs) {
+		fmt.Fprintf(&data, "output %s %d %s\n", key, state.UTXOs[key].Amount, state.UTXOs[key].Address)
+	}
+
+	return SHA256([]byte(data.String()))
+}
+
+
+func sortedKeys(stateMap interface{}) []string {
+	var keys []string
+	switch typedMap := stateMap.(type) {
+	case map[string]int64:
+		for key := range typedMap {
+			keys = append(keys, key)
+		}
+	case map[string]int:
+		for key := range typedMap {
+			keys = append(keys, key)
+		}
+	case map[string]string:
+		for key := range typedMap {
+			keys = append(keys, key)
+		}
+	case UTXOSet:
+		for key := range typedMap {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+
+// LoadChainState loads the chain state snapshot and applies the blocks added since it was saved
+// needs to be called before Balance or AccountNonce
+func LoadChainState() {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	tipState = buildChainState()
+	saveSnapshot()
+}
+
+
+// builds the chain state after the highest block without saving it, the caller holds chainLock
+func buildChainState() *ChainState {
+	state, found := loadSnapshot()
+	if !found {
+		fmt.Println("Chain state snapshot missing or invalid, rebuilding from the genesis block...")
+		state = NewChainState()
+	}
+
+	height := blockStore.Height()
+	for i := state.Height + 1; i <= height; i++ {
+		blockString, _ := blockStore.LoadBlock(i)
+		state.ApplyBlock(DeserialiseBlock(blockString))
+	}
+	return state
+}
+
+
+// the snapshot is only used if its checksum matches and the block it was taken at is still in the main chain
+func loadSnapshot() (*ChainState, bool) {
+	data, err := ioutil.ReadFile(blockchainFolder + "/" + stateFilename)
+	if err != nil {
+		return nil, false
+	}
+
+	snapshot := stateSnapshot{State: NewChainState()}
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil || snapshot.State == nil || snapshot.Checksum != snapshot.State.Checksum() {
+		return nil, false
+	}
+
+	height, found := blockStore.HeightOfHash(snapshot.TipHash)
+	if !found || height != snapshot.State.Height {
+		return nil, false
+	}
+
+	// empty maps are saved as null
+	state := snapshot.State
+	if state.Balances == nil || state.Nonces == nil || state.PublicKeys == nil || state.PublicKeyHeights == nil || state.UTXOs == nil {
+		return nil, false
+	}
+
+	return state, true
+}
+
+
+func saveSnapshot() error {
+	blockString, err := blockStore.LoadBlock(tipState.Height)
+	if err != nil {
+		return err
+	}
+
+	snapshot := stateSnapshot{}
+	snapshot.TipHash = DeserialiseBlock(blockString).Hash
+	snapshot.Checksum = tipState.Checksum()
+	snapshot.State = tipState
+
+	snapshotString, err := Serialise(snapshot)
+	if err != nil {
+		return err
+	}
+	return fileutil.AtomicWriteFile(blockchainFolder + "/" + stateFilename, []byte(snapshotString), 0644)
+}
+
+
+// adds a block connected to the main chain to the tip state
+func connectTipState(block coin.Block) {
+	if tipState == nil {
+		return
+	}
+
+	tipState.ApplyBlock(block)
+	if tipState.Height % snapshotInterval == 0 {
+		saveSnapshot()
+	}
+}
+
+
+// removes a block disconnected from the main chain from the tip state, the block has to still be in the block store
+func disconnectTipState(block coin.Block) {
+	if tipState == nil {
+		return
+	}
+
+	tipState.UndoBlock(block, mainChainOutput)
+}
+
+
+func mainChainOutput(txId string, outputIndex int) (coin.TxOutput, bool) {
+	location, found := blockStore.FindTransaction(txId)
+	if !found {
+		return coin.TxOutput{}, false
+	}
+	blockString, err := blockStore.LoadBlock(location.Height)
+	if err != nil {
+		return coin.TxOutput{}, false
+	}
+
+	body := DeserialiseBlock(blockString).Body
+	if location.Index >= len(body) || outputIndex < 0 || outputIndex >= len(body[location.Index].Outputs) {
+		return coin.TxOutput{}, false
+	}
+	return body[location.Index].Outputs[outputIndex], true
+}
+
+
+// Balance returns the account balance of a wallet on the main chain
+func Balance(address string) int64 {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return tipState.Balances[address]
+}
+
+
+// AccountNonce returns the nonce the wallets next account transaction needs on the main chain
+func AccountNonce(address string) int {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return tipState.Nonces[address]
+}
+
+
+// PublicKeys returns the pgp public keys of every wallet address that has one on the main chain
+func PublicKeys() map[string]string {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	publicKeys := make(map[string]string, len(tipState.PublicKeys))
+	for address, publicKeyPem := range tipState.PublicKeys {
+		publicKeys[address] = publicKeyPem
+	}
+	return publicKeys
+}
+
+
+// UnspentOutputs returns the outputs a wallet owns on the main chain
+func UnspentOutputs(address string) []coin.UnspentOutput {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return tipState.UTXOs.OutputsForAddress(address)
+}
+
+
+// ValidUTXOTransaction checks a UTXO transactions inputs are unspent on the main chain and its outputs match
+// publicKeyPem returns the pgp public key of a wallet address, it's called with chainLock held
+func ValidUTXOTransaction(tx coin.Transaction, publicKeyPem func(string) (string, bool)) (bool, string) {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	return tipState.UTXOs.ValidTransaction(tx, publicKeyPem)
+}
@@ -0,0 +1,580 @@
+package blockchain
+
+import (
+	"pocketcoin/coin"
+	"pocketcoin/netpack"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+
+// ---- Headers-First Sync ----
+// syncing starts by downloading the headers after the local tip from several nodes at once
+// each nodes header chain is checked (links, targets, proof of work and timestamps) before any block is downloaded,
+// the valid chain with the most work is synced and nodes that send invalid headers get a ban score
+// the blocks are then split into batches that are downloaded in parallel from every node that has them
+// a batch that times out or comes back wrong is given to another node, blocks are added in order as their batch arrives
+// after startup KeepSynced runs the same sync every SyncInterval, so blocks missed while offline or busy are caught up
+// and a node left on a branch with less work moves over to the network's branch
+
+
+const MaxHeadersPerMessage = 2000
+const MaxBlocksPerMessage = 16
+const maxSyncPeers = 8  // nodes asked for their headers
+const downloadWindow = 32  // batches downloaded ahead of the next batch to add
+const maxBatchAttempts = 5
+const maxPeerFailures = 3  // failed requests in a row before a node is dropped from the download
+const invalidHeadersScore = 50
+const invalidBlocksScore = 20
+const SyncInterval = 30 * time.Second
+
+
+// A header chain sent by a node, following on from a main chain block
+type headerChain struct {
+	address string
+	fork *blockNode  // main chain block the headers build on
+	headers []coin.BlockHeader  // headers[i] is at height fork.Height + 1 + i
+	hashes []string
+	work *big.Int  // cumulative work up to the last header
+}
+
+
+// A batch of blocks downloaded with one request
+type blockBatch struct {
+	height int  // height of the first block
+	hashes []string
+	blocks []coin.Block
+	address string  // node the blocks came from
+	downloading bool
+	downloaded bool
+	attempts int
+}
+
+
+var syncNow = make(chan struct{}, 1)
+
+
+type blockDownload struct {
+	batches []*blockBatch
+	next int  // index of the next batch to add to the blockchain
+	workers int  // nodes still downloading
+	err error  // set once the download can't finish
+	lock sync.Mutex
+	changed *sync.Cond
+}
+
+
+// SyncBlockchain downloads the blocks the nodes have that the main chain doesn't, needs LoadBlockIndex and LoadChainState first
+// returns the changes made to the main chain, blocks added before an error are kept
+func SyncBlockchain(addresses []string) (ChainUpdate, error) {
+	update := ChainUpdate{}
+	if len(addresses) > maxSyncPeers {
+		addresses = addresses[:maxSyncPeers]
+	}
+
+	chains := downloadHeaderChains(addresses)
+	var best *headerChain
+	for _, chain := range chains {
+		if best == nil || chain.work.Cmp(best.work) > 0 {
+			best = chain
+		}
+	}
+	if best == nil || best.work.Cmp(ChainWork()) <= 0 {
+		return update, nil
+	}
+
+	download := &blockDownload{workers: len(chains)}
+	download.changed = sync.NewCond(&download.lock)
+	for start := 0; start < len(best.hashes); start += MaxBlocksPerMessage {
+		end := start + MaxBlocksPerMessage
+		if end > len(best.hashes) {
+			end = len(best.hashes)
+		}
+		batch := &blockBatch{height: best.fork.Height + 1 + start, hashes: best.hashes[start:end]}
+		download.batches = append(download.batches, batch)
+	}
+
+	fmt.Printf("Downloading %d blocks from %d nodes...\n", len(best.hashes), len(chains))
+	for _, chain := range chains {
+		go download.downloadFrom(chain)
+	}
+
+	added := 0
+	for i := range download.batches {
+		batch, err := download.wait(i)
+		if err != nil {
+			download.stop(err)
+			return update, err
+		}
+
+		for _, block := range batch.blocks {
+			blockUpdate, accepted, reason := ProcessBlock(block)
+			if !accepted && reason != KnownBlockReason {
+				netpack.Misbehaving(batch.address, invalidBlocksScore, reason)
+				err := fmt.Errorf("block %s from %s invalid: %s", block.Header.BlockId, batch.address, reason)
+				download.stop(err)
+				return update, err
+			}
+			update = mergeChainUpdates(update, blockUpdate)
+		}
+
+		added += len(batch.blocks)
+		download.added(i)
+		if (i + 1) % 10 == 0 || i == len(download.batches) - 1 {
+			fmt.Printf("Added %d of %d blocks, blockchain height %d\n", added, len(best.hashes), Height())
+		}
+	}
+
+	return update, nil
+}
+
+
+// KeepSynced syncs from the nodes every SyncInterval, or sooner if RequestSync is called, and never returns
+// onUpdate is called with the changes whenever the main chain changes
+func KeepSynced(nodes func() []string, onUpdate func(ChainUpdate)) {
+	timer := time.NewTimer(SyncInterval)
+	for {
+		select {
+		case <-timer.C:
+		case <-syncNow:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		update, err := SyncBlockchain(nodes())
+		if len(update.Connected) > 0 || len(update.Disconnected) > 0 {
+			fmt.Printf("Background sync: %d blocks connected, %d disconnected, blockchain height %d\n", len(update.Connected), len(update.Disconnected), Height())
+			onUpdate(update)
+		}
+		if err != nil {
+			fmt.Println("Background sync failed:", err)
+		}
+		timer.Reset(SyncInterval)
+	}
+}
+
+
+// RequestSync wakes KeepSynced up to sync straight away, used when a block shows the blockchain is behind
+func RequestSync() {
+	select {
+	case syncNow <- struct{}{}:
+	default:
+	}
+}
+
+
+// asks each node for its headers at the same time, only the valid chains with new headers are returned
+func downloadHeaderChains(addresses []string) []*headerChain {
+	locator := blockLocator()
+	results := make([]*headerChain, len(addresses))
+
+	var wait sync.WaitGroup
+	for i, address := range addresses {
+		wait.Add(1)
+		go func(i int, address string) {
+			defer wait.Done()
+			chain, err := downloadHeaders(address, locator)
+			if err != nil {
+				fmt.Printf("Unable to sync headers from %s: %s\n", address, err)
+				return
+			}
+			results[i] = chain
+		}(i, address)
+	}
+	wait.Wait()
+
+	var chains []*headerChain
+	for _, chain := range results {
+		if chain != nil && len(chain.headers) > 0 {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+
+// downloads and checks the headers a node has after the locator, nil if it has none
+func downloadHeaders(address string, locator []string) (*headerChain, error) {
+	var chain *headerChain
+	for {
+		headers, err := requestHeaders(address, locator)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			return chain, nil
+		}
+
+		if chain == nil {
+			fork, found := mainChainNode(headers[0].PrevBlockHash)
+			if !found {
+				return nil, errors.New("headers do not follow on from the blockchain")
+			}
+			chain = &headerChain{address: address, fork: fork, work: new(big.Int).Set(fork.Work)}
+		}
+
+		err = chain.add(headers)
+		if err != nil {
+			netpack.Misbehaving(address, invalidHeadersScore, err.Error())
+			return nil, err
+		}
+
+		if len(headers) < MaxHeadersPerMessage {
+			return chain, nil
+		}
+		locator = []string{chain.tipHash()}
+	}
+}
+
+
+// ForkPoint asks a node for the headers after the main chain and returns the height of the last main chain block
+// its chain shares, diverged is false if the node has no blocks the main chain doesn't, needs LoadBlockIndex first
+func ForkPoint(address string) (int, bool, error) {
+	headers, err := requestHeaders(address, blockLocator())
+	if err != nil {
+		return 0, false, err
+	}
+	if len(headers) == 0 {
+		return Height(), false, nil
+	}
+
+	fork, found := mainChainNode(headers[0].PrevBlockHash)
+	if !found {
+		return 0, false, errors.New("headers do not follow on from the blockchain")
+	}
+	return fork.Height, true, nil
+}
+
+
+// blockLocator lists main chain hashes from the tip back to the genesis block, 10 one apart then doubling the gap
+func blockLocator() []string {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	var locator []string
+	step := 1
+	for height := len(mainChain) - 1; height > 0; height -= step {
+		locator = append(locator, mainChain[height].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, mainChain[0].Hash)
+}
+
+
+func mainChainNode(blockHash string) (*blockNode, bool) {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	node, known := blockIndex[blockHash]
+	if !known || !node.inMainChain() {
+		return nil, false
+	}
+	return node, true
+}
+
+
+// HeadersAfter returns up to MaxHeadersPerMessage main chain headers after the first locator hash in the main chain
+func HeadersAfter(locator []string) []coin.BlockHeader {
+	chainLock.Lock()
+	defer chainLock.Unlock()
+
+	start := 1  // every node on the network has the same genesis block
+	for _, blockHash := range locator {
+		if node, known := blockIndex[blockHash]; known && node.inMainChain() {
+			start = node.Height + 1
+			break
+		}
+	}
+
+	headers := []coin.BlockHeader{}
+	for height := start; height < len(mainChain) && len(headers) < MaxHeadersPerMessage; height++ {
+		headers = append(headers, mainChain[height].Header)
+	}
+	return headers
+}
+
+
+// BlocksByHash returns up to MaxBlocksPerMessage blocks, stopping at the first block that isn't known
+func BlocksByHash(hashes []string) []coin.Block {
+	blocks := []coin.Block{}
+	for _, blockHash := range hashes {
+		if len(blocks) >= MaxBlocksPerMessage {
+			break
+		}
+		block, found := GetBlockByHash(blockHash)
+		if !found {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+
+func (chain *headerChain) tipHash() string {
+	if len(chain.hashes) == 0 {
+		return chain.fork.Hash
+	}
+	return chain.hashes[len(chain.hashes)-1]
+}
+
+
+func (chain *headerChain) tipHeader() coin.BlockHeader {
+	if len(chain.headers) == 0 {
+		return chain.fork.Header
+	}
+	return chain.headers[len(chain.headers)-1]
+}
+
+
+// header returns the header at a height, heights up to the fork come from the main chain
+func (chain *headerChain) header(height int) (coin.BlockHeader, bool) {
+	if height > chain.fork.Height {
+		i := height - chain.fork.Height - 1
+		if i >= len(chain.headers) {
+			return coin.BlockHeader{}, false
+		}
+		return chain.headers[i], true
+	}
+
+	node := chain.fork
+	for node != nil && node.Height > height {
+		node = node.Parent
+	}
+	if node == nil || node.Height != height {
+		return coin.BlockHeader{}, false
+	}
+	return node.Header, true
+}
+
+
+func (chain *headerChain) contains(height int, blockHash string) bool {
+	i := height - chain.fork.Height - 1
+	return i >= 0 && i < len(chain.hashes) && chain.hashes[i] == blockHash
+}
+
+
+// add checks each header follows on from the chain before adding it
+func (chain *headerChain) add(headers []coin.BlockHeader) error {
+	for _, header := range headers {
+		blockHash := HeaderHash(header)
+
+		// the locator gets sparser going back so the first headers can be blocks already in the main chain
+		if len(chain.headers) == 0 {
+			if node, found := mainChainNode(blockHash); found && node.Parent == chain.fork {
+				chain.fork = node
+				chain.work = new(big.Int).Set(node.Work)
+				continue
+			}
+		}
+
+		prevHeader := chain.tipHeader()
+		target := nextTarget(prevHeader, chain.header)
+		headerValid, invalidReason := verifyHeader(blockHash, header, chain.tipHash(), prevHeader, target)
+		if !headerValid {
+			return errors.New("header " + header.BlockId + " invalid: " + invalidReason)
+		}
+
+		chain.headers = append(chain.headers, header)
+		chain.hashes = append(chain.hashes, blockHash)
+		chain.work.Add(chain.work, BlockWork(header))
+	}
+	return nil
+}
+
+
+// downloads batches the node has until there are none left, or the node fails too many times in a row
+func (download *blockDownload) downloadFrom(chain *headerChain) {
+	defer download.workerDone()
+
+	failures := 0
+	for failures < maxPeerFailures {
+		batch := download.take(chain)
+		if batch == nil {
+			return
+		}
+
+		blocks, err := requestBlocks(chain.address, batch.hashes)
+		if err == nil && len(blocks) != len(batch.hashes) {
+			err = errors.New("node no longer has the blocks")
+		} else if err == nil {
+			err = checkBlocks(batch.hashes, blocks)
+			if err != nil {
+				netpack.Misbehaving(chain.address, invalidBlocksScore, err.Error())
+			}
+		}
+
+		if err != nil {
+			failures++
+			fmt.Printf("Unable to download blocks from %s: %s\n", chain.address, err)
+		} else {
+			failures = 0
+		}
+		download.finish(batch, blocks, chain.address, err)
+	}
+}
+
+
+// checks each block is the block with the header that was asked for
+func checkBlocks(hashes []string, blocks []coin.Block) error {
+	for i, block := range blocks {
+		if block.Hash != hashes[i] || HeaderHash(block.Header) != hashes[i] {
+			return errors.New("received a different block to the one requested")
+		}
+		if MerkleRoot(block.Body) != block.Header.MerkleRoot {
+			return errors.New("block " + block.Header.BlockId + " merkle root hash invalid")
+		}
+	}
+	return nil
+}
+
+
+// take returns the next batch in the window the node has, waiting while other nodes are downloading
+// returns nil once there's nothing left the node can download
+func (download *blockDownload) take(chain *headerChain) *blockBatch {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	for download.err == nil {
+		waiting := false
+		for i := download.next; i < len(download.batches); i++ {
+			batch := download.batches[i]
+			last := len(batch.hashes) - 1
+			if batch.downloaded || !chain.contains(batch.height + last, batch.hashes[last]) {
+				continue
+			}
+			if !batch.downloading && i < download.next + downloadWindow {
+				batch.downloading = true
+				return batch
+			}
+			waiting = true
+		}
+		if !waiting {
+			return nil
+		}
+		download.changed.Wait()
+	}
+	return nil
+}
+
+
+func (download *blockDownload) finish(batch *blockBatch, blocks []coin.Block, address string, err error) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	batch.downloading = false
+	if err == nil {
+		batch.blocks = blocks
+		batch.address = address
+		batch.downloaded = true
+	} else {
+		batch.attempts++
+		if batch.attempts >= maxBatchAttempts && download.err == nil {
+			download.err = fmt.Errorf("blocks from height %d failed to download %d times", batch.height, batch.attempts)
+		}
+	}
+	download.changed.Broadcast()
+}
+
+
+func (download *blockDownload) workerDone() {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	download.workers--
+	download.changed.Broadcast()
+}
+
+
+// wait returns the batch once it's downloaded, or an error if it never will be
+func (download *blockDownload) wait(i int) (*blockBatch, error) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	batch := download.batches[i]
+	for !batch.downloaded {
+		if download.err != nil {
+			return nil, download.err
+		}
+		if download.workers == 0 {
+			return nil, errors.New("no nodes left to download the blocks from")
+		}
+		download.changed.Wait()
+	}
+	return batch, nil
+}
+
+
+// added moves the download window on once a batch is in the blockchain
+func (download *blockDownload) added(i int) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	download.batches[i].blocks = nil
+	download.next = i + 1
+	download.changed.Broadcast()
+}
+
+
+func (download *blockDownload) stop(err error) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+
+	if download.err == nil {
+		download.err = err
+	}
+	download.changed.Broadcast()
+}
+
+
+func requestHeaders(address string, locator []string) ([]coin.BlockHeader, error) {
+	request, _ := Serialise(coin.GetHeadersRequest{Locator: locator})
+	response, err := syncRequest(address, "GetHeaders", request, "Headers")
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []coin.BlockHeader
+	err = json.Unmarshal([]byte(response), &headers)
+	if err == nil && len(headers) > MaxHeadersPerMessage {
+		err = errors.New("too many headers")
+	}
+	return headers, err
+}
+
+
+func requestBlocks(address string, hashes []string) ([]coin.Block, error) {
+	request, _ := Serialise(hashes)
+	response, err := syncRequest(address, "GetBlocks", request, "Blocks")
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []coin.Block
+	err = json.Unmarshal([]byte(response), &blocks)
+	return blocks, err
+}
+
+
+// sends a request to a node and returns the body of the response
+func syncRequest(address string, request string, body string, responseRequest string) (string, error) {
+	reqHeader := netpack.ConstructRequestHeader("generic", request)
+	packet := netpack.ConstructNetworkPacket(reqHeader, body)
+	packetString, _ := Serialise(packet)
+
+	success, response := netpack.BroadcastDuplexPacket(packetString, address)
+	if !success {
+		return "", errors.New("no response")
+	}
+	if response.Header.Request != responseRequest {
+		return "", errors.New("expected " + responseRequest + ", got " + response.Header.Request)
+	}
+	return response.Body, nil
+}
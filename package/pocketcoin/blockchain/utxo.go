@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"math"
+	"pocketcoin/coin"
+	"pocketcoin/pgp"
+	"strconv"
+	"sort"
+	"strings"
+	b64 "encoding/base64"
+)
+
+
+// ---- UTXO Transactions ----
+// UTXO transactions sit alongside the account balance model
+// a UTXO transaction spends the outputs of previous UTXO transactions (Inputs) and can also
+// draw Amount from the senders account balance, the total is then split between its Outputs and the Fee
+// each input is signed by the owner of the output it spends, the sender signs the transaction if Amount is drawn
+
+
+// maps "txId:outputIndex" to the unspent output
+type UTXOSet map[string]coin.TxOutput
+
+
+func outPointKey(txId string, outputIndex int) string {
+	return txId + ":" + strconv.Itoa(outputIndex)
+}
+
+
+func IsUTXOTransaction(tx coin.Transaction) bool {
+	return len(tx.Inputs) > 0 || len(tx.Outputs) > 0
+}
+
+
+// SigningString returns the binary encoding of the transaction with all signatures removed, this is what gets signed
+func SigningString(tx coin.Transaction) string {
+	tx.Signature = ""
+	if len(tx.Inputs) > 0 {
+		inputs := make([]coin.TxInput, len(tx.Inputs))
+		copy(inputs, tx.Inputs)
+		for i := range inputs {
+			inputs[i].Signature = ""
+		}
+		tx.Inputs = inputs
+	}
+
+	return string(coin.EncodeTransaction(tx))
+}
+
+
+func SignatureValid(message string, signatureString string, publicKeyPem string) bool {
+	publicKey, err := pgp.ParsePublicKeyFromPemStr(publicKeyPem)
+	if err != nil {
+		return false
+	}
+	// the decoder skips newlines, so only the canonical encoding is accepted or anyone relaying the transaction
+	// could change its signature string, and so its id, without making it invalid
+	signature, err := b64.StdEncoding.DecodeString(signatureString)
+	if err != nil || b64.StdEncoding.EncodeToString(signature) != signatureString {
+		return false
+	}
+
+	return pgp.ValidSignature(message, signature, publicKey)
+}
+
+
+func (set UTXOSet) ApplyBlock(block coin.Block) {
+	for _, tx := range block.Body {
+		set.ApplyTransaction(tx)
+	}
+}
+
+
+func (set UTXOSet) ApplyTransaction(tx coin.Transaction) {
+	if !IsUTXOTransaction(tx) {
+		return
+	}
+
+	for _, input := range tx.Inputs {
+		delete(set, outPointKey(input.PrevTxId, input.OutputIndex))
+	}
+
+	txId := TransactionHash(tx)
+	for i, output := range tx.Outputs {
+		set[outPointKey(txId, i)] = output
+	}
+}
+
+
+func (set UTXOSet) Unspent(txId string, outputIndex int) (coin.TxOutput, bool) {
+	output, unspent := set[outPointKey(txId, outputIndex)]
+	return output, unspent
+}
+
+
+func (set UTXOSet) OutputsForAddress(address string) []coin.UnspentOutput {
+	keys := []string{}
+	for key, output := range set {
+		if output.Address == address {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	outputs := []coin.UnspentOutput{}
+	for _, key := range keys {
+		split := strings.LastIndex(key, ":")
+		unspent := coin.UnspentOutput{}
+		unspent.TxId = key[:split]
+		unspent.OutputIndex, _ = strconv.Atoi(key[split+1:])
+		unspent.Output = set[key]
+		outputs = append(outputs, unspent)
+	}
+
+	return outputs
+}
+
+
+func (set UTXOSet) Balance(address string) int64 {
+	balance := int64(0)
+	for _, output := range set {
+		if output.Address == address {
+			balance += output.Amount
+		}
+	}
+	return balance
+}
+
+
+// adds two non negative amounts, false if the sum doesn't fit in an int64
+func addAmounts(total int64, amount int64) (int64, bool) {
+	if amount < 0 || total > math.MaxInt64 - amount {
+		return total, false
+	}
+	return total + amount, true
+}
+
+
+// ValidTransaction checks every input is unspent and signed by its owner, and that the outputs match what is spent
+// publicKeyPem returns the pgp public key of a wallet address
+func (set UTXOSet) ValidTransaction(tx coin.Transaction, publicKeyPem func(string) (string, bool)) (bool, string) {
+	if len(tx.Outputs) == 0 {
+		return false, "Transaction has no outputs"
+	}
+	if tx.ToAddress != "" {
+		return false, "UTXO transaction can not credit an account"
+	}
+	if tx.Amount < 0 || tx.Fee < 0 {
+		return false, "Transaction amount invalid"
+	}
+
+	signingString := SigningString(tx)
+	ownerKeyValid := func(address string, signature string) bool {
+		keyPem, found := publicKeyPem(address)
+		if !found || SHA256([]byte(keyPem))[:32] != address {
+			return false
+		}
+		return SignatureValid(signingString, signature, keyPem)
+	}
+
+	inputTotal := int64(0)
+	spent := make(map[string]bool)
+	for _, input := range tx.Inputs {
+		key := outPointKey(input.PrevTxId, input.OutputIndex)
+		if spent[key] {
+			return false, "Output spent twice in the same transaction"
+		}
+		spent[key] = true
+
+		output, unspent := set[key]
+		if !unspent {
+			return false, "Input spends an output that is spent or does not exist"
+		}
+		if !ownerKeyValid(output.Address, input.Signature) {
+			return false, "Input signature invalid"
+		}
+		var valid bool
+		if inputTotal, valid = addAmounts(inputTotal, output.Amount); !valid {
+			return false, "Input total too large"
+		}
+	}
+
+	outputTotal := int64(0)
+	for _, output := range tx.Outputs {
+		if output.Amount <= 0 || output.Address == "" {
+			return false, "Output invalid"
+		}
+		var valid bool
+		if outputTotal, valid = addAmounts(outputTotal, output.Amount); !valid {
+			return false, "Output total too large"
+		}
+	}
+
+	if tx.Amount > 0 && !ownerKeyValid(tx.FromAddress, tx.Signature) {
+		return false, "Sender signature invalid"
+	}
+
+	spendTotal, spendValid := addAmounts(inputTotal, tx.Amount)
+	payTotal, payValid := addAmounts(outputTotal, tx.Fee)
+	if !spendValid || !payValid {
+		return false, "Transaction total too large"
+	}
+	if payTotal != spendTotal {
+		return false, "Outputs do not match the amount spent"
+	}
+
+	return true, ""
+}
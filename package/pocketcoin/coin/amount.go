@@ -0,0 +1,75 @@
+package coin
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+
+// amounts are whole numbers of the smallest unit of PocketCoin (0.000001)
+
+
+const Coin int64 = 1000000  // smallest units in one coin
+const AmountDecimals = 6
+
+
+var ErrInvalidAmount = errors.New("invalid amount, expected a number with up to 6 decimal places")
+
+
+// FormatAmount formats an amount in coins, e.g. 10500000 -> "10.500000"
+func FormatAmount(amount int64) string {
+	sign := ""
+	absAmount := uint64(amount)
+	if amount < 0 {
+		sign = "-"
+		absAmount = uint64(-amount)
+	}
+
+	whole := strconv.FormatUint(absAmount / uint64(Coin), 10)
+	fraction := strconv.FormatUint(absAmount % uint64(Coin), 10)
+	fraction = strings.Repeat("0", AmountDecimals - len(fraction)) + fraction
+
+	return sign + whole + "." + fraction
+}
+
+
+// ParseAmount parses an amount in coins with up to 6 decimal places, e.g. "0.25" -> 250000
+func ParseAmount(amountString string) (int64, error) {
+	amountString = strings.TrimSpace(amountString)
+	negative := strings.HasPrefix(amountString, "-")
+	amountString = strings.TrimPrefix(amountString, "-")
+
+	whole := amountString
+	fraction := ""
+	if i := strings.Index(amountString, "."); i != -1 {
+		whole = amountString[:i]
+		fraction = amountString[i+1:]
+	}
+
+	if whole == "" && fraction == "" || len(fraction) > AmountDecimals {
+		return 0, ErrInvalidAmount
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	fraction = fraction + strings.Repeat("0", AmountDecimals - len(fraction))
+
+	for _, digit := range whole + fraction {
+		if digit < '0' || digit > '9' {
+			return 0, ErrInvalidAmount
+		}
+	}
+
+	wholeCoins, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || wholeCoins > (1<<63 - 1) / Coin - 1 {
+		return 0, ErrInvalidAmount
+	}
+	fractionUnits, _ := strconv.ParseInt(fraction, 10, 64)
+
+	amount := wholeCoins * Coin + fractionUnits
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
@@ -7,17 +7,42 @@ type BlockHeader struct {
 	MerkleRoot string
 	Timestamp string
 	Nonce int
-	TargetBits float64
+	TargetBits uint32  // compact encoding of the target
 }
 
 
 type Transaction struct {
-	Amount float64
+	Amount int64  // in the smallest unit, see amount.go
+	Fee int64  // paid to the miner that includes the transaction
+	Nonce int  // number of earlier transactions drawn from the senders account, stops old transactions being replayed
 	ToAddress string
 	FromAddress string
 	Signature string
 	PublicKey string
 	Timestamp string
+	Inputs []TxInput `json:",omitempty"`  // only used by UTXO transactions
+	Outputs []TxOutput `json:",omitempty"`
+}
+
+
+// Spends an output of a previous UTXO transaction, signed by the owner of that output
+type TxInput struct {
+	PrevTxId string
+	OutputIndex int
+	Signature string
+}
+
+
+type TxOutput struct {
+	Amount int64
+	Address string
+}
+
+
+type UnspentOutput struct {
+	TxId string
+	OutputIndex int
+	Output TxOutput
 }
 
 
@@ -28,13 +53,89 @@ type Block struct {
 }
 
 
+// Proof that a transaction is included in a block, lets light clients
+// check a transaction without downloading the whole block
+type MerkleProof struct {
+	Header BlockHeader
+	TxHash string
+	Index int
+	Branch []string  // sibling hashes from the leaf up to the root
+}
+
+
+type MerkleProofRequest struct {
+	BlockId string
+	TxHash string
+}
+
+
+// A node's answer to a GetTransaction request
+type TransactionStatus struct {
+	TxId string
+	Transaction Transaction
+	Pending bool  // waiting in the transaction pool
+	BlockHeight int  // main chain block containing the transaction, -1 while pending
+	BlockHash string
+	Confirmations int  // 1 once in the highest block, plus one for each block on top of it
+}
+
+
+// Asks a node for the main chain headers that follow the first locator hash it has
+type GetHeadersRequest struct {
+	Locator []string  // main chain block hashes from the senders tip back to the genesis block, further apart going back
+}
+
+
 type RequestHeader struct {
 	Node string  // wallet, node, miner
 	Request string  // transaction, balalnce, dns, block mined, etc
+	Address string  // host:port the sender listens on, empty for wallets
+}
+
+
+// Sent by both sides of a connection before any other message
+type VersionMessage struct {
+	ProtocolVersion int
+	NetworkId string  // genesis block hash of the network
+	BestHeight int  // -1 for wallets
+	UserAgent string
+	Services uint64  // bit flags, see netpack
+	Address string  // host:port the sender listens on, empty for wallets
+}
+
+
+// A transaction or block announced in an Inv message or asked for in a GetData message
+type InvItem struct {
+	Type string  // tx or block
+	Hash string
+}
+
+
+// A peer address sent in a Peers message
+type PeerAddress struct {
+	Address string  // host:port
+	Node string  // node or miner
 }
 
 
 type NetworkPacket struct {
 	Header RequestHeader
 	Body string  // serialised struct
+}
+
+
+// Parameters shared by every program on a network, loaded from the network parameters file
+type NetworkParams struct {
+	NetworkName string
+	BlockVersion float64
+	BlockReward int64
+	MaxBlockTransactions int  // not including the coinbase transaction
+	BlockTime int  // desired seconds between blocks, the target is retargeted towards it
+	GenesisTargetBits uint32
+	GenesisTimestamp string
+	Allocations []TxOutput  // coins given out by the genesis block
+	GenesisNonce int  // set by the genesis command
+	GenesisHash string
+	SeedNodes []string  // host:port addresses of the peers to connect to first
+	SeedMiners []string
 }
\ No newline at end of file
@@ -0,0 +1,276 @@
+package coin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+)
+
+
+// ---- Canonical Binary Encoding ----
+// every hash and signature is computed over this encoding rather than json so other tools can agree on hashes
+// all integers are big endian and fixed width (amounts are int64), floats are encoded as their IEEE 754 bits in a uint64
+// strings are a uint32 byte length followed by the bytes, lists are a uint32 item count followed by the items
+//
+// BlockHeader:  Version, BlockId, PrevBlockHash, MerkleRoot, Timestamp, TargetBits (uint32), Nonce (uint64)
+// Transaction:  Amount, Fee, Nonce (uint64), ToAddress, FromAddress, Signature, PublicKey, Timestamp, Inputs, Outputs
+// TxInput:      PrevTxId, OutputIndex (uint32), Signature
+// TxOutput:     Amount, Address
+// Block:        Hash, Header, Body
+//
+// the nonce is the last field of the header so miners only need to change the last 8 bytes
+// a transaction id is the double sha256 of the whole transaction encoding, signatures included
+
+
+const HeaderNonceSize = 8
+
+var ErrShortData = errors.New("unexpected end of encoded data")
+var ErrTrailingData = errors.New("unexpected data after end of encoding")
+
+
+type encoder struct {
+	data []byte
+}
+
+
+func (e *encoder) uint32(value uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	e.data = append(e.data, buf[:]...)
+}
+
+
+func (e *encoder) uint64(value uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	e.data = append(e.data, buf[:]...)
+}
+
+
+func (e *encoder) float64(value float64) {
+	e.uint64(math.Float64bits(value))
+}
+
+
+func (e *encoder) string(value string) {
+	e.uint32(uint32(len(value)))
+	e.data = append(e.data, value...)
+}
+
+
+type decoder struct {
+	data []byte
+	err error
+}
+
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = ErrShortData
+		return nil
+	}
+	taken := d.data[:n]
+	d.data = d.data[n:]
+	return taken
+}
+
+
+func (d *decoder) uint32() uint32 {
+	taken := d.take(4)
+	if taken == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(taken)
+}
+
+
+func (d *decoder) uint64() uint64 {
+	taken := d.take(8)
+	if taken == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(taken)
+}
+
+
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+
+func (d *decoder) string() string {
+	length := d.uint32()
+	if uint64(length) > uint64(len(d.data)) {
+		d.err = ErrShortData
+		return ""
+	}
+	return string(d.take(int(length)))
+}
+
+
+// each list item takes at least a byte so a count larger than the remaining data is invalid
+func (d *decoder) count() int {
+	count := d.uint32()
+	if uint64(count) > uint64(len(d.data)) {
+		d.err = ErrShortData
+		return 0
+	}
+	return int(count)
+}
+
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		return ErrTrailingData
+	}
+	return d.err
+}
+
+
+func (e *encoder) header(header BlockHeader) {
+	e.float64(header.Version)
+	e.string(header.BlockId)
+	e.string(header.PrevBlockHash)
+	e.string(header.MerkleRoot)
+	e.string(header.Timestamp)
+	e.uint32(header.TargetBits)
+	e.uint64(uint64(header.Nonce))
+}
+
+
+func (d *decoder) header() BlockHeader {
+	header := BlockHeader{}
+	header.Version = d.float64()
+	header.BlockId = d.string()
+	header.PrevBlockHash = d.string()
+	header.MerkleRoot = d.string()
+	header.Timestamp = d.string()
+	header.TargetBits = d.uint32()
+	header.Nonce = int(d.uint64())
+	return header
+}
+
+
+func (e *encoder) transaction(tx Transaction) {
+	e.uint64(uint64(tx.Amount))
+	e.uint64(uint64(tx.Fee))
+	e.uint64(uint64(tx.Nonce))
+	e.string(tx.ToAddress)
+	e.string(tx.FromAddress)
+	e.string(tx.Signature)
+	e.string(tx.PublicKey)
+	e.string(tx.Timestamp)
+
+	e.uint32(uint32(len(tx.Inputs)))
+	for _, input := range tx.Inputs {
+		e.string(input.PrevTxId)
+		e.uint32(uint32(input.OutputIndex))
+		e.string(input.Signature)
+	}
+
+	e.uint32(uint32(len(tx.Outputs)))
+	for _, output := range tx.Outputs {
+		e.uint64(uint64(output.Amount))
+		e.string(output.Address)
+	}
+}
+
+
+func (d *decoder) transaction() Transaction {
+	tx := Transaction{}
+	tx.Amount = int64(d.uint64())
+	tx.Fee = int64(d.uint64())
+	tx.Nonce = int(d.uint64())
+	tx.ToAddress = d.string()
+	tx.FromAddress = d.string()
+	tx.Signature = d.string()
+	tx.PublicKey = d.string()
+	tx.Timestamp = d.string()
+
+	numInputs := d.count()
+	for i := 0; i < numInputs && d.err == nil; i++ {
+		input := TxInput{}
+		input.PrevTxId = d.string()
+		input.OutputIndex = int(d.uint32())
+		input.Signature = d.string()
+		tx.Inputs = append(tx.Inputs, input)
+	}
+
+	numOutputs := d.count()
+	for i := 0; i < numOutputs && d.err == nil; i++ {
+		output := TxOutput{}
+		output.Amount = int64(d.uint64())
+		output.Address = d.string()
+		tx.Outputs = append(tx.Outputs, output)
+	}
+
+	return tx
+}
+
+
+func EncodeBlockHeader(header BlockHeader) []byte {
+	e := encoder{}
+	e.header(header)
+	return e.data
+}
+
+
+func DecodeBlockHeader(data []byte) (BlockHeader, error) {
+	d := decoder{data: data}
+	header := d.header()
+	return header, d.finish()
+}
+
+
+func EncodeTransaction(tx Transaction) []byte {
+	e := encoder{}
+	e.transaction(tx)
+	return e.data
+}
+
+
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := decoder{data: data}
+	tx := d.transaction()
+	return tx, d.finish()
+}
+
+
+// TransactionId is the hex hash that identifies a transaction, merkle trees and the block store index are built from it
+func TransactionId(tx Transaction) string {
+	firstHash := sha256.Sum256(EncodeTransaction(tx))
+	secondHash := sha256.Sum256(firstHash[:])
+	return hex.EncodeToString(secondHash[:])
+}
+
+
+func EncodeBlock(block Block) []byte {
+	e := encoder{}
+	e.string(block.Hash)
+	e.header(block.Header)
+	e.uint32(uint32(len(block.Body)))
+	for _, tx := range block.Body {
+		e.transaction(tx)
+	}
+	return e.data
+}
+
+
+func DecodeBlock(data []byte) (Block, error) {
+	d := decoder{data: data}
+	block := Block{}
+	block.Hash = d.string()
+	block.Header = d.header()
+
+	numTxs := d.count()
+	for i := 0; i < numTxs && d.err == nil; i++ {
+		block.Body = append(block.Body, d.transaction())
+	}
+
+	return block, d.finish()
+}
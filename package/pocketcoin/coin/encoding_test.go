@@ -0,0 +1,166 @@
+package coin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+
+var testHeader = BlockHeader{
+	Version: 0.1,
+	BlockId: "1",
+	PrevBlockHash: strings.Repeat("0", 64),
+	MerkleRoot: strings.Repeat("ab", 32),
+	Timestamp: "2021-05-07 13:48:37 +0100 BST",
+	Nonce: 12345,
+	TargetBits: 0x1f00ffff,
+}
+
+
+var testTransactions = []Transaction{
+	{},
+	{Amount: 10 * Coin, ToAddress: "0d947ab07e03a2f33debb98b41ed5ea4", FromAddress: "coinbase", Timestamp: "2021-05-07 13:48:37 +0100 BST"},
+	{
+		Amount: 250000,
+		Fee: 1000,
+		Nonce: 3,
+		ToAddress: "1234567890abcdef1234567890abcdef",
+		FromAddress: "0d947ab07e03a2f33debb98b41ed5ea4",
+		Signature: "c2lnbmF0dXJl",
+		PublicKey: "-----BEGIN PUBLIC KEY-----\nkey\n-----END PUBLIC KEY-----\n",
+		Timestamp: "2021-05-07 13:50:01 +0100 BST",
+	},
+	{
+		Amount: 500000,
+		Fee: 2000,
+		ToAddress: "1234567890abcdef1234567890abcdef",
+		FromAddress: "0d947ab07e03a2f33debb98b41ed5ea4",
+		Inputs: []TxInput{{PrevTxId: strings.Repeat("cd", 32), OutputIndex: 1, Signature: "aW5wdXQ="}},
+		Outputs: []TxOutput{{Amount: 300000, Address: "1234567890abcdef1234567890abcdef"}, {Amount: 198000, Address: "0d947ab07e03a2f33debb98b41ed5ea4"}},
+	},
+	{Amount: -1, Fee: -1, Nonce: 1 << 40},
+}
+
+
+func TestBlockHeaderRoundTrip(t *testing.T) {
+	headers := []BlockHeader{{}, testHeader, {Version: 1, BlockId: "0", PrevBlockHash: "genesis", Nonce: 1<<63 - 1}}
+
+	for _, header := range headers {
+		decoded, err := DecodeBlockHeader(EncodeBlockHeader(header))
+		if err != nil {
+			t.Errorf("DecodeBlockHeader(%+v): %s", header, err)
+		} else if decoded != header {
+			t.Errorf("header round trip = %+v, want %+v", decoded, header)
+		}
+	}
+}
+
+
+func TestTransactionRoundTrip(t *testing.T) {
+	for _, tx := range testTransactions {
+		decoded, err := DecodeTransaction(EncodeTransaction(tx))
+		if err != nil {
+			t.Errorf("DecodeTransaction(%+v): %s", tx, err)
+		} else if !reflect.DeepEqual(decoded, tx) {
+			t.Errorf("transaction round trip = %+v, want %+v", decoded, tx)
+		}
+	}
+}
+
+
+func TestBlockRoundTrip(t *testing.T) {
+	blocks := []Block{
+		{},
+		{Hash: strings.Repeat("ef", 32), Header: testHeader, Body: testTransactions[1:2]},
+		{Hash: strings.Repeat("ef", 32), Header: testHeader, Body: testTransactions},
+	}
+
+	for _, block := range blocks {
+		decoded, err := DecodeBlock(EncodeBlock(block))
+		if err != nil {
+			t.Errorf("DecodeBlock(%+v): %s", block, err)
+		} else if !reflect.DeepEqual(decoded, block) {
+			t.Errorf("block round trip = %+v, want %+v", decoded, block)
+		}
+	}
+}
+
+
+func TestDecodeInvalid(t *testing.T) {
+	header := EncodeBlockHeader(testHeader)
+	tx := EncodeTransaction(testTransactions[3])
+	block := EncodeBlock(Block{Header: testHeader, Body: testTransactions})
+
+	tests := []struct {
+		name string
+		decode func([]byte) error
+		data []byte
+		err error
+	}{
+		{"empty header", decodeHeaderErr, nil, ErrShortData},
+		{"short header", decodeHeaderErr, header[:len(header)-1], ErrShortData},
+		{"header with trailing data", decodeHeaderErr, append(header[:len(header):len(header)], 0), ErrTrailingData},
+		{"short transaction", decodeTransactionErr, tx[:len(tx)-1], ErrShortData},
+		{"transaction with trailing data", decodeTransactionErr, append(tx[:len(tx):len(tx)], 0), ErrTrailingData},
+		{"transaction input count past the data", decodeTransactionErr, []byte(strings.Repeat("\x00", 44) + "\xff\xff\xff\xff"), ErrShortData},
+		{"short block", decodeBlockErr, block[:len(block)-1], ErrShortData},
+		{"block with trailing data", decodeBlockErr, append(block[:len(block):len(block)], 0), ErrTrailingData},
+	}
+
+	for _, test := range tests {
+		if err := test.decode(test.data); err != test.err {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+
+func decodeHeaderErr(data []byte) error {
+	_, err := DecodeBlockHeader(data)
+	return err
+}
+
+
+func decodeTransactionErr(data []byte) error {
+	_, err := DecodeTransaction(data)
+	return err
+}
+
+
+func decodeBlockErr(data []byte) error {
+	_, err := DecodeBlock(data)
+	return err
+}
+
+
+// known answers worked out separately from the format described at the top of encoding.go, they change if the encoding does
+func TestBlockHeaderKnownAnswer(t *testing.T) {
+	wantEncoding := "3fb999999999999a" +  // Version 0.1
+		"00000001" + "31" +  // BlockId
+		"00000040" + strings.Repeat("30", 64) +  // PrevBlockHash
+		"00000040" + strings.Repeat("6162", 32) +  // MerkleRoot
+		"0000001d" + hex.EncodeToString([]byte(testHeader.Timestamp)) +
+		"1f00ffff" +  // TargetBits
+		"0000000000003039"  // Nonce
+	wantHash := "ee097c2dae7d9d849cf7c82a1ca7f90ec7f32f709bd8a995372994cba0196215"
+
+	encoded := EncodeBlockHeader(testHeader)
+	if encoding := hex.EncodeToString(encoded); encoding != wantEncoding {
+		t.Errorf("EncodeBlockHeader = %s, want %s", encoding, wantEncoding)
+	}
+
+	// the header hash is the double sha256 of the encoding
+	firstHash := sha256.Sum256(encoded)
+	secondHash := sha256.Sum256(firstHash[:])
+	if hash := hex.EncodeToString(secondHash[:]); hash != wantHash {
+		t.Errorf("header hash = %s, want %s", hash, wantHash)
+	}
+
+	// the nonce is the last HeaderNonceSize bytes so miners only change the end of the header
+	if nonce := hex.EncodeToString(encoded[len(encoded)-HeaderNonceSize:]); nonce != "0000000000003039" {
+		t.Errorf("nonce bytes = %s, want 0000000000003039", nonce)
+	}
+}
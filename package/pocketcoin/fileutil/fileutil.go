@@ -0,0 +1,53 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+
+// ---- Crash Safe Writes ----
+// files are written to a temporary file that is synced to disk then renamed over the old file
+// so a crash leaves either the old file or the new one, never a partly written file
+
+
+// AtomicWriteFile replaces the file with data, after a crash the file has either its old or new contents
+func AtomicWriteFile(filename string, data []byte, perm os.FileMode) error {
+	tempFilename := filename + ".tmp"
+	file, err := os.OpenFile(tempFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+
+	err = os.Rename(tempFilename, filename)
+	if err != nil {
+		return err
+	}
+
+	SyncDir(filepath.Dir(filename))
+	return nil
+}
+
+
+// SyncDir makes sure renames are on disk, directories can't be synced on every OS so errors are ignored
+func SyncDir(dir string) {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	dirFile.Sync()
+	dirFile.Close()
+}
@@ -0,0 +1,3 @@
+module fileutil
+
+go 1.14
@@ -0,0 +1,328 @@
+package mempool
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pocketcoin/blockchain"
+	"pocketcoin/coin"
+)
+
+
+// ---- Transaction Pool ----
+// transactions waiting to be mined, shared by every connection goroutine so each method takes the pool's lock
+// transactions are indexed by hash, by sender and by the outputs they spend so lookups don't scan the pool
+// two pending transactions conflict if they draw from the same account with the same nonce or spend the same output,
+// the second one is rejected
+// once the pool is full the transaction paying the lowest fee per byte is evicted to make room for one paying more
+// transactions that have waited longer than the expiry are dropped, the sender can send them again
+// a sender's account transactions have to be mined in nonce order, so when one is evicted, expires or is removed
+// the sender's pending account transactions with higher nonces go with it
+
+
+const DefaultMaxSize = 5000
+const DefaultExpiry = 24 * time.Hour
+
+var ErrKnown = errors.New("transaction already in the pool")
+var ErrPoolFull = errors.New("pool is full and the transaction fee is too low")
+
+
+type entry struct {
+	tx coin.Transaction
+	hash string
+	size int
+	added time.Time
+}
+
+
+type Pool struct {
+	lock sync.Mutex
+	maxSize int
+	expiry time.Duration
+
+	entries map[string]*entry  // tx hash -> entry
+	bySender map[string]map[string]*entry  // sender address -> tx hash -> entry
+	spends map[string]string  // "txid:index" of a spent output -> hash of the transaction spending it
+}
+
+
+func New(maxSize int, expiry time.Duration) *Pool {
+	pool := &Pool{maxSize: maxSize, expiry: expiry}
+	pool.entries = make(map[string]*entry)
+	pool.bySender = make(map[string]map[string]*entry)
+	pool.spends = make(map[string]string)
+	return pool
+}
+
+
+func outPointKey(txId string, outputIndex int) string {
+	return txId + ":" + strconv.Itoa(outputIndex)
+}
+
+
+// Add adds a transaction that has already been checked against the chain state
+// returns an error if it's already in the pool, conflicts with a pending transaction or pays too little to fit
+func (pool *Pool) Add(tx coin.Transaction) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.expire()
+
+	newEntry := &entry{tx: tx, hash: blockchain.TransactionHash(tx), size: blockchain.TransactionSize(tx), added: time.Now()}
+	if _, known := pool.entries[newEntry.hash]; known {
+		return ErrKnown
+	}
+	if conflict, found := pool.conflict(tx); found {
+		return errors.New("transaction conflicts with pending transaction " + conflict)
+	}
+
+	if len(pool.entries) >= pool.maxSize {
+		lowest := pool.lowestFeeRate(tx)
+		if lowest == nil || !higherFeeRate(newEntry, lowest) {
+			return ErrPoolFull
+		}
+		pool.removeWithFollowing(lowest.hash)
+	}
+
+	pool.entries[newEntry.hash] = newEntry
+	if pool.bySender[tx.FromAddress] == nil {
+		pool.bySender[tx.FromAddress] = make(map[string]*entry)
+	}
+	pool.bySender[tx.FromAddress][newEntry.hash] = newEntry
+	for _, input := range tx.Inputs {
+		pool.spends[outPointKey(input.PrevTxId, input.OutputIndex)] = newEntry.hash
+	}
+
+	return nil
+}
+
+
+// returns the hash of a pending transaction that conflicts with tx
+func (pool *Pool) conflict(tx coin.Transaction) (string, bool) {
+	if blockchain.SpendsFromAccount(tx) {
+		for hash, pending := range pool.bySender[tx.FromAddress] {
+			if blockchain.SpendsFromAccount(pending.tx) && pending.tx.Nonce == tx.Nonce {
+				return hash, true
+			}
+		}
+	}
+	for _, input := range tx.Inputs {
+		if hash, spent := pool.spends[outPointKey(input.PrevTxId, input.OutputIndex)]; spent {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+
+func higherFeeRate(a *entry, b *entry) bool {
+	return a.tx.Fee * int64(b.size) > b.tx.Fee * int64(a.size)
+}
+
+
+// returns the transaction to evict to make room for tx, never one that tx needs to be mined first
+func (pool *Pool) lowestFeeRate(tx coin.Transaction) *entry {
+	var lowest *entry
+	for _, pending := range pool.entries {
+		if follows(tx, pending.tx) {
+			continue
+		}
+		if lowest == nil || higherFeeRate(lowest, pending) {
+			lowest = pending
+		}
+	}
+	return lowest
+}
+
+
+// returns whether tx is an account transaction from the same sender with a higher nonce than prev
+func follows(tx coin.Transaction, prev coin.Transaction) bool {
+	return tx.FromAddress == prev.FromAddress && blockchain.SpendsFromAccount(tx) &&
+		blockchain.SpendsFromAccount(prev) && tx.Nonce > prev.Nonce
+}
+
+
+func (pool *Pool) remove(hash string) {
+	pending, found := pool.entries[hash]
+	if !found {
+		return
+	}
+
+	delete(pool.entries, hash)
+	delete(pool.bySender[pending.tx.FromAddress], hash)
+	if len(pool.bySender[pending.tx.FromAddress]) == 0 {
+		delete(pool.bySender, pending.tx.FromAddress)
+	}
+	for _, input := range pending.tx.Inputs {
+		key := outPointKey(input.PrevTxId, input.OutputIndex)
+		if pool.spends[key] == hash {
+			delete(pool.spends, key)
+		}
+	}
+}
+
+
+// removes the transaction and the sender's account transactions that can't be mined without it
+func (pool *Pool) removeWithFollowing(hash string) {
+	removed, found := pool.entries[hash]
+	if !found {
+		return
+	}
+
+	for otherHash, pending := range pool.bySender[removed.tx.FromAddress] {
+		if follows(pending.tx, removed.tx) {
+			pool.remove(otherHash)
+		}
+	}
+	pool.remove(hash)
+}
+
+
+func (pool *Pool) expire() {
+	for hash, pending := range pool.entries {
+		if time.Since(pending.added) > pool.expiry {
+			pool.removeWithFollowing(hash)
+		}
+	}
+}
+
+
+// Remove removes the transaction and the sender's pending account transactions with higher nonces
+func (pool *Pool) Remove(hash string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.removeWithFollowing(hash)
+}
+
+
+// RemoveBlock removes the blocks transactions, and pending transactions that conflict with them, from the pool
+func (pool *Pool) RemoveBlock(block coin.Block) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, tx := range block.Body {
+		pool.remove(blockchain.TransactionHash(tx))
+		if conflict, found := pool.conflict(tx); found {
+			pool.remove(conflict)
+		}
+	}
+}
+
+
+func (pool *Pool) Has(hash string) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	_, found := pool.entries[hash]
+	return found
+}
+
+
+func (pool *Pool) Get(hash string) (coin.Transaction, bool) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pending, found := pool.entries[hash]
+	if !found {
+		return coin.Transaction{}, false
+	}
+	return pending.tx, true
+}
+
+
+func (pool *Pool) Count() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return len(pool.entries)
+}
+
+
+// ByFeeRate returns the pending transactions paying the highest fee per byte first, oldest first for equal rates
+func (pool *Pool) ByFeeRate() []coin.Transaction {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.expire()
+
+	pending := make([]*entry, 0, len(pool.entries))
+	for _, e := range pool.entries {
+		pending = append(pending, e)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if higherFeeRate(pending[i], pending[j]) || higherFeeRate(pending[j], pending[i]) {
+			return higherFeeRate(pending[i], pending[j])
+		}
+		return pending[i].added.Before(pending[j].added)
+	})
+
+	transactions := make([]coin.Transaction, len(pending))
+	for i, e := range pending {
+		transactions[i] = e.tx
+	}
+	return transactions
+}
+
+
+// Debit returns the total the senders pending transactions take from its account balance
+func (pool *Pool) Debit(address string) int64 {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	debit := int64(0)
+	for _, pending := range pool.bySender[address] {
+		debit += blockchain.AccountDebit(pending.tx)
+	}
+	return debit
+}
+
+
+// BySender returns the senders pending transactions, oldest first
+// a sender's account transactions are only added once the one before is pending, so they're in nonce order
+func (pool *Pool) BySender(address string) []coin.Transaction {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pending := make([]*entry, 0, len(pool.bySender[address]))
+	for _, e := range pool.bySender[address] {
+		pending = append(pending, e)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].added.Before(pending[j].added)
+	})
+
+	transactions := make([]coin.Transaction, len(pending))
+	for i, e := range pending {
+		transactions[i] = e.tx
+	}
+	return transactions
+}
+
+
+// PendingNonces returns how many pending transactions draw from the senders account
+func (pool *Pool) PendingNonces(address string) int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	count := 0
+	for _, pending := range pool.bySender[address] {
+		if blockchain.SpendsFromAccount(pending.tx) {
+			count++
+		}
+	}
+	return count
+}
+
+
+// OutputSpent returns whether a pending transaction spends the output
+func (pool *Pool) OutputSpent(txId string, outputIndex int) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	_, spent := pool.spends[outPointKey(txId, outputIndex)]
+	return spent
+}
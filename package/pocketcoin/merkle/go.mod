@@ -0,0 +1,3 @@
+module merkle
+
+go 1.14
@@ -0,0 +1,107 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+
+// Leaves are hex encoded transaction ids, the tree is built by hashing each
+// pair of nodes with double SHA256, if a level has an odd number of nodes
+// the last node is paired with itself
+
+
+func doubleHash(left []byte, right []byte) []byte {
+	pair := append(append([]byte{}, left...), right...)
+	first := sha256.Sum256(pair)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+
+func decodeLeaves(leaves []string) ([][]byte, bool) {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		leafBytes, err := hex.DecodeString(leaf)
+		if err != nil {
+			return nil, false
+		}
+		level[i] = leafBytes
+	}
+	return level, true
+}
+
+
+func nextLevel(level [][]byte) [][]byte {
+	if len(level)%2 == 1 {
+		level = append(level, level[len(level)-1])
+	}
+
+	parents := make([][]byte, 0, len(level)/2)
+	for i := 0; i < len(level); i += 2 {
+		parents = append(parents, doubleHash(level[i], level[i+1]))
+	}
+	return parents
+}
+
+
+// Root returns the merkle root of the leaves, or "" if there are no leaves
+func Root(leaves []string) string {
+	level, ok := decodeLeaves(leaves)
+	if !ok || len(level) == 0 {
+		return ""
+	}
+
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return hex.EncodeToString(level[0])
+}
+
+
+// Branch returns the sibling hashes needed to rebuild the root from the leaf
+// at the given index, ordered from the bottom of the tree to the top
+func Branch(leaves []string, index int) ([]string, bool) {
+	level, ok := decodeLeaves(leaves)
+	if !ok || index < 0 || index >= len(level) {
+		return nil, false
+	}
+
+	branch := []string{}
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		branch = append(branch, hex.EncodeToString(level[sibling]))
+
+		level = nextLevel(level)
+		index = index / 2
+	}
+	return branch, true
+}
+
+
+// VerifyBranch checks that the leaf at the given index hashes up to the root
+func VerifyBranch(leaf string, index int, branch []string, root string) bool {
+	current, err := hex.DecodeString(leaf)
+	if err != nil || index < 0 {
+		return false
+	}
+
+	for _, siblingHex := range branch {
+		sibling, err := hex.DecodeString(siblingHex)
+		if err != nil {
+			return false
+		}
+
+		if index%2 == 0 {
+			current = doubleHash(current, sibling)
+		} else {
+			current = doubleHash(sibling, current)
+		}
+		index = index / 2
+	}
+
+	return index == 0 && hex.EncodeToString(current) == root
+}
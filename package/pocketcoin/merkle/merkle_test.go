@@ -0,0 +1,128 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+
+// leaf returns a fixed 32 byte leaf, the sha256 of the single byte i
+func leaf(i int) string {
+	hash := sha256.Sum256([]byte{byte(i)})
+	return hex.EncodeToString(hash[:])
+}
+
+
+func leaves(n int) []string {
+	result := make([]string, n)
+	for i := range result {
+		result[i] = leaf(i)
+	}
+	return result
+}
+
+
+func hashPair(left string, right string) string {
+	leftBytes, _ := hex.DecodeString(left)
+	rightBytes, _ := hex.DecodeString(right)
+	return hex.EncodeToString(doubleHash(leftBytes, rightBytes))
+}
+
+
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		name string
+		leaves []string
+		root string
+	}{
+		{"no leaves", nil, ""},
+		{"invalid hex", []string{"not hex"}, ""},
+		{"one leaf", leaves(1), "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{"two leaves", leaves(2), "f0a886c2f0065f43c82d12b561b45f1a963917248c538474aaad05440a48df3c"},
+		{"three leaves", leaves(3), "50fde71c451737ad83c79d791dfda614eeed7e4440971b7a92691919a06ba52b"},
+		{"five leaves", leaves(5), "f570734e3e3e401dad09b8f51499dfb2f631c803b88487ef65b88baa069430d0"},
+	}
+
+	for _, test := range tests {
+		if root := Root(test.leaves); root != test.root {
+			t.Errorf("%s: Root = %q, want %q", test.name, root, test.root)
+		}
+	}
+}
+
+
+// an odd level pairs its last node with itself, so the root is the same as with the last leaf repeated
+func TestRootOddLeavesDuplicatesLast(t *testing.T) {
+	three := leaves(3)
+	want := hashPair(hashPair(three[0], three[1]), hashPair(three[2], three[2]))
+	if root := Root(three); root != want {
+		t.Errorf("Root of 3 leaves = %s, want %s", root, want)
+	}
+
+	for _, n := range []int{3, 5, 7, 9} {
+		odd := leaves(n)
+		even := append(leaves(n), odd[n-1])
+		if Root(odd) != Root(even) {
+			t.Errorf("%d leaves: root differs from the root with the last leaf repeated", n)
+		}
+	}
+}
+
+
+func TestBranchEveryLeaf(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		tree := leaves(n)
+		root := Root(tree)
+
+		for index := 0; index < n; index++ {
+			branch, ok := Branch(tree, index)
+			if !ok {
+				t.Fatalf("%d leaves: no branch for index %d", n, index)
+			}
+			if !VerifyBranch(tree[index], index, branch, root) {
+				t.Errorf("%d leaves: branch for index %d doesn't verify", n, index)
+			}
+			if VerifyBranch(leaf(n), index, branch, root) {
+				t.Errorf("%d leaves: branch for index %d verifies a leaf that isn't in the tree", n, index)
+			}
+			if sibling := index ^ 1; sibling < n && VerifyBranch(tree[index], sibling, branch, root) {
+				t.Errorf("%d leaves: branch for index %d verifies at index %d", n, index, sibling)
+			}
+		}
+	}
+}
+
+
+func TestBranchInvalid(t *testing.T) {
+	tree := leaves(4)
+	branch, _ := Branch(tree, 1)
+	root := Root(tree)
+
+	tests := []struct {
+		name string
+		leaf string
+		index int
+		branch []string
+		root string
+	}{
+		{"negative index", tree[1], -1, branch, root},
+		{"index past the tree", tree[1], 5, branch, root},
+		{"short branch", tree[1], 1, branch[:1], root},
+		{"invalid sibling", tree[1], 1, []string{"not hex", branch[1]}, root},
+		{"wrong root", tree[1], 1, branch, Root(leaves(3))},
+	}
+
+	for _, test := range tests {
+		if VerifyBranch(test.leaf, test.index, test.branch, test.root) {
+			t.Errorf("%s: VerifyBranch = true, want false", test.name)
+		}
+	}
+
+	if _, ok := Branch(tree, 4); ok {
+		t.Errorf("Branch for an index past the tree succeeded")
+	}
+	if _, ok := Branch(tree, -1); ok {
+		t.Errorf("Branch for a negative index succeeded")
+	}
+}
@@ -0,0 +1,171 @@
+package mining
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// ---- Mining Engine ----
+// the serialised block header is split around the nonce into a prefix and a suffix
+// the sha256 state after hashing the prefix is computed once, so each attempt only hashes the nonce and the suffix
+// the nonce space is split into one range per worker and each worker searches its own range
+// block hashes are sha256(sha256(header)), the same as blockchain.HeaderHash, with the nonce as a big endian uint64
+
+
+const checkInterval = 4096  // hashes between each check of the stop flag
+const reportInterval = 10 * time.Second
+
+
+type Template struct {
+	Prefix []byte  // header bytes before the nonce
+	Suffix []byte  // header bytes after the nonce
+}
+
+
+type Result struct {
+	Found bool
+	Nonce int
+	Hash string
+	Hashes uint64
+	Elapsed time.Duration
+}
+
+
+func (result Result) HashRate() float64 {
+	seconds := result.Elapsed.Seconds()
+	if seconds == 0 {
+		return 0
+	}
+	return float64(result.Hashes) / seconds
+}
+
+
+func FormatHashRate(hashRate float64) string {
+	units := []string{"H/s", "kH/s", "MH/s", "GH/s"}
+	unit := 0
+	for hashRate >= 1000 && unit < len(units)-1 {
+		hashRate /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.2f %s", hashRate, units[unit])
+}
+
+
+func targetBytes(target *big.Int) []byte {
+	padded := make([]byte, sha256.Size)
+	targetBytes := target.Bytes()
+	if len(targetBytes) > sha256.Size {
+		for i := range padded {
+			padded[i] = 0xff
+		}
+		return padded
+	}
+	copy(padded[sha256.Size-len(targetBytes):], targetBytes)
+	return padded
+}
+
+
+func prefixState(prefix []byte) []byte {
+	digest := sha256.New()
+	digest.Write(prefix)
+	state, _ := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	return state
+}
+
+
+// Mine searches for a nonce that gives a header hash below the target, stopping early if stop is set to non zero
+// progress is called every 10 seconds with the current hash rate, it can be nil
+func Mine(template Template, target *big.Int, workers int, stop *int32, progress func(float64)) Result {
+	if workers < 1 {
+		workers = 1
+	}
+
+	target32 := targetBytes(target)
+	midstate := prefixState(template.Prefix)
+	// the header nonce is an int, so on 32 bit platforms only the nonces below 2^31 are searched
+	maxNonce := uint64(^uint(0) >> 1)
+	span := maxNonce / uint64(workers)
+
+	result := Result{}
+	var resultLock sync.Mutex
+	var hashes uint64
+	var found int32
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(firstNonce uint64, lastNonce uint64) {
+			defer wg.Done()
+
+			digest := sha256.New()
+			restore := digest.(encoding.BinaryUnmarshaler)
+			nonceBytes := make([]byte, 8)
+			firstHash := make([]byte, 0, sha256.Size)
+			count := uint64(0)
+
+			for nonce := firstNonce; nonce < lastNonce; nonce++ {
+				restore.UnmarshalBinary(midstate)
+				binary.BigEndian.PutUint64(nonceBytes, nonce)
+				digest.Write(nonceBytes)
+				digest.Write(template.Suffix)
+				firstHash = digest.Sum(firstHash[:0])
+				blockHash := sha256.Sum256(firstHash)
+				count++
+
+				if bytes.Compare(blockHash[:], target32) < 0 {
+					if atomic.CompareAndSwapInt32(&found, 0, 1) {
+						resultLock.Lock()
+						result.Found = true
+						result.Nonce = int(nonce)
+						result.Hash = hex.EncodeToString(blockHash[:])
+						resultLock.Unlock()
+					}
+					break
+				}
+
+				if count == checkInterval {
+					atomic.AddUint64(&hashes, count)
+					count = 0
+					if atomic.LoadInt32(&found) != 0 || atomic.LoadInt32(stop) != 0 {
+						return
+					}
+				}
+			}
+			atomic.AddUint64(&hashes, count)
+		}(uint64(i)*span, uint64(i+1)*span)
+	}
+
+	done := make(chan bool)
+	if progress != nil {
+		go func() {
+			ticker := time.NewTicker(reportInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					progress(float64(atomic.LoadUint64(&hashes)) / time.Since(start).Seconds())
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+
+	result.Hashes = atomic.LoadUint64(&hashes)
+	result.Elapsed = time.Since(start)
+
+	return result
+}
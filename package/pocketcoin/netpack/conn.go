@@ -0,0 +1,237 @@
+package netpack
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"pocketcoin/coin"
+)
+
+
+// ---- Peer Connections ----
+// a connection stays open after the handshake and carries any number of framed messages
+// messages are written by a goroutine per connection from a send queue, so a slow peer doesn't hold up the sender
+// if a peer's queue fills up its messages are dropped instead of blocking
+// every read and write has a deadline, idle connections are closed by the side that accepted them
+// outgoing connections are kept in a pool and reused for the next message to the same address
+
+
+const sendQueueSize = 100
+const writeTimeout = 30 * time.Second
+const responseTimeout = 30 * time.Second  // time to wait for the response to a request
+const IdleTimeout = 2 * time.Minute  // time an accepted connection waits for the next message
+const poolIdleTimeout = IdleTimeout / 2  // pooled connections are redialled before the peer closes them
+
+var ErrConnClosed = errors.New("connection closed")
+
+
+// A connection to a peer that has completed the handshake
+type Conn struct {
+	conn net.Conn
+	reader *bufio.Reader
+	Version coin.VersionMessage  // version sent by the peer
+	Address string  // host:port the peer listens on, verified in the handshake, empty if it couldn't be
+	banScore int  // guarded by peerLock, only used while Address is empty
+
+	sendQueue chan []byte
+	sendLock sync.Mutex  // guards closed so nothing is queued after the queue is closed
+	closed bool
+	done chan struct{}  // closed once the send queue is written and the connection closed
+
+	requestLock sync.Mutex  // one request waits for its response at a time
+	lastUsed time.Time  // guarded by sendLock
+	inventoryTracked bool  // guarded by sendLock
+}
+
+
+var connPool = make(map[string]*Conn)  // address -> outgoing connection
+var poolLock sync.Mutex
+
+
+func newConn(conn net.Conn) *Conn {
+	peer := &Conn{conn: conn, reader: bufio.NewReader(conn)}
+	peer.sendQueue = make(chan []byte, sendQueueSize)
+	peer.done = make(chan struct{})
+	peer.lastUsed = time.Now()
+	go peer.writeLoop()
+	return peer
+}
+
+
+func (peer *Conn) writeLoop() {
+	failed := false
+	for frame := range peer.sendQueue {
+		if failed {
+			continue
+		}
+		peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := peer.conn.Write(frame)
+		if err != nil {
+			failed = true
+			go peer.Close()
+		}
+	}
+	peer.conn.Close()
+	close(peer.done)
+}
+
+
+func (peer *Conn) RemoteAddr() net.Addr {
+	return peer.conn.RemoteAddr()
+}
+
+
+// Send queues a serialised NetworkPacket to be written to the peer
+func (peer *Conn) Send(packetString string) error {
+	frame, err := encodeFrame(packetString)
+	if err != nil {
+		return err
+	}
+
+	peer.sendLock.Lock()
+	defer peer.sendLock.Unlock()
+
+	if peer.closed {
+		return ErrConnClosed
+	}
+	peer.lastUsed = time.Now()
+	select {
+	case peer.sendQueue <- frame:
+		return nil
+	default:
+		return errors.New("send queue full")
+	}
+}
+
+
+func (peer *Conn) WritePacket(packet coin.NetworkPacket) error {
+	packetString, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	return peer.Send(string(packetString))
+}
+
+
+// ReadPacket waits up to IdleTimeout for the next message
+func (peer *Conn) ReadPacket() (coin.NetworkPacket, error) {
+	return peer.readPacket(IdleTimeout)
+}
+
+
+func (peer *Conn) readPacket(timeout time.Duration) (coin.NetworkPacket, error) {
+	peer.conn.SetReadDeadline(time.Now().Add(timeout))
+	packet, err := readFrame(peer.reader)
+	if err != nil {
+		peer.Close()
+	}
+	return packet, err
+}
+
+
+// Request sends a serialised NetworkPacket and waits for the peer's response
+func (peer *Conn) Request(packetString string) (coin.NetworkPacket, error) {
+	peer.requestLock.Lock()
+	defer peer.requestLock.Unlock()
+
+	err := peer.Send(packetString)
+	if err != nil {
+		return coin.NetworkPacket{}, err
+	}
+	return peer.readPacket(responseTimeout)
+}
+
+
+// starts tracking the items the peer has, called once the handshake has verified its address
+func (peer *Conn) trackInventory() {
+	peer.sendLock.Lock()
+	defer peer.sendLock.Unlock()
+
+	if !peer.closed && peer.Address != "" {
+		peer.inventoryTracked = trackInventory(peer.Address)
+	}
+}
+
+
+// Close stops new messages being queued, the connection is closed once the queued messages are written
+func (peer *Conn) Close() error {
+	peer.sendLock.Lock()
+	defer peer.sendLock.Unlock()
+
+	if !peer.closed {
+		peer.closed = true
+		close(peer.sendQueue)
+		if peer.inventoryTracked {
+			untrackInventory(peer.Address)
+		}
+	}
+	return nil
+}
+
+
+// a pooled connection is reused if it's open and hasn't been idle long enough for the peer to close it
+func (peer *Conn) reusable() bool {
+	peer.sendLock.Lock()
+	defer peer.sendLock.Unlock()
+
+	return !peer.closed && time.Since(peer.lastUsed) < poolIdleTimeout
+}
+
+
+// pooledConn returns the open connection to the address, connecting if there isn't one
+func pooledConn(address string) (*Conn, error) {
+	address, valid := NormaliseAddress(address)
+	if !valid {
+		return nil, &net.AddrError{Err: "invalid peer address", Addr: address}
+	}
+
+	poolLock.Lock()
+	peer, found := connPool[address]
+	if found && !peer.reusable() {
+		peer.Close()
+		delete(connPool, address)
+		found = false
+	}
+	poolLock.Unlock()
+	if found {
+		return peer, nil
+	}
+
+	peer, err := Connect(address)
+	if err != nil {
+		return nil, err
+	}
+
+	poolLock.Lock()
+	if existing, found := connPool[address]; found && existing.reusable() {
+		// another goroutine connected first
+		peer.Close()
+		peer = existing
+	} else {
+		connPool[address] = peer
+	}
+	poolLock.Unlock()
+
+	return peer, nil
+}
+
+
+// CloseConnections closes every pooled connection and waits for their queued messages to be written
+func CloseConnections() {
+	poolLock.Lock()
+	var peers []*Conn
+	for address, peer := range connPool {
+		peers = append(peers, peer)
+		delete(connPool, address)
+	}
+	poolLock.Unlock()
+
+	for _, peer := range peers {
+		peer.Close()
+		<-peer.done
+	}
+}
@@ -0,0 +1,183 @@
+package netpack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"pocketcoin/coin"
+)
+
+
+// ---- Version Handshake ----
+// as soon as a connection is opened both sides send a Version message with their protocol version, network id
+// (the genesis block hash), best height, user agent and services, then check the version they receive
+// if it's acceptable they reply VerAck, otherwise Reject with the reason and the connection is closed
+// no other message is sent or read until both sides have sent VerAck, so peers from a network with a
+// different genesis block, peers that are too old and banned peers never get to send blocks or transactions
+
+
+const ProtocolVersion = 5  // 2 replaced the block by block sync with headers-first sync, 3 added Inv and GetData, 4 added GetTransaction, 5 added SubmitTransaction
+const MinProtocolVersion = 4  // oldest protocol version still accepted
+const handshakeTimeout = 10 * time.Second
+
+// services offered by a peer, sent as bit flags in the Version message
+const (
+	ServiceBlocks uint64 = 1 << iota  // stores the blockchain and answers block, balance and sync requests
+	ServiceMining  // mines blocks
+)
+
+var localVersion = coin.VersionMessage{ProtocolVersion: ProtocolVersion, BestHeight: -1}
+var bestHeight func() int
+
+
+// SetLocalVersion sets the Version message sent in handshakes, heightFunc is called for each handshake and can be nil
+func SetLocalVersion(networkId string, userAgent string, services uint64, heightFunc func() int) {
+	localVersion.NetworkId = networkId
+	localVersion.UserAgent = userAgent
+	localVersion.Services = services
+	bestHeight = heightFunc
+}
+
+
+// PeerType returns whether a peer with the services is a node or a miner, empty for wallets
+func PeerType(services uint64) string {
+	if services & ServiceBlocks != 0 {
+		return NodePeer
+	} else if services & ServiceMining != 0 {
+		return MinerPeer
+	}
+	return ""
+}
+
+
+// Connect dials a peer and performs the handshake, the connection isn't pooled
+func Connect(address string) (*Conn, error) {
+	conn, err := Dial(address)
+	address, _ = NormaliseAddress(address)
+	if err != nil {
+		peerFailed(address)
+		return nil, err
+	}
+
+	peer, err := handshake(conn, address)
+	if err != nil {
+		peerFailed(address)
+		return nil, err
+	}
+	peerConnected(address)
+	return peer, nil
+}
+
+
+// Accept performs the handshake on a connection from a peer
+func Accept(conn net.Conn) (*Conn, error) {
+	return handshake(conn, "")
+}
+
+
+// dialled is the address the connection was made to, empty for accepted connections
+func handshake(conn net.Conn, dialled string) (*Conn, error) {
+	peer := newConn(conn)
+
+	version := localVersion
+	version.Address = listenAddress
+	if bestHeight != nil {
+		version.BestHeight = bestHeight()
+	}
+	versionString, _ := json.Marshal(version)
+	err := peer.WritePacket(handshakePacket("Version", string(versionString)))
+
+	packet := coin.NetworkPacket{}
+	if err == nil {
+		packet, err = peer.readPacket(handshakeTimeout)
+	}
+	if err == nil && packet.Header.Request != "Version" {
+		err = errors.New("expected a Version message, got " + packet.Header.Request)
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(packet.Body), &peer.Version)
+	}
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+
+	peer.Address = dialled
+	if peer.Address == "" {
+		peer.Address = verifyAddress(peer.Version.Address, conn)
+	}
+	err = checkVersion(peer.Version, peer.Address)
+	if err != nil {
+		peer.WritePacket(handshakePacket("Reject", err.Error()))
+		peer.Close()
+		return nil, err
+	}
+
+	err = peer.WritePacket(handshakePacket("VerAck", ""))
+	if err == nil {
+		packet, err = peer.readPacket(handshakeTimeout)
+	}
+	if err == nil && packet.Header.Request == "Reject" {
+		err = errors.New("rejected by peer: " + packet.Body)
+	} else if err == nil && packet.Header.Request != "VerAck" {
+		err = errors.New("expected a VerAck message, got " + packet.Header.Request)
+	}
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+
+	peer.trackInventory()
+	return peer, nil
+}
+
+
+func handshakePacket(request string, body string) coin.NetworkPacket {
+	header := ConstructRequestHeader(PeerType(localVersion.Services), request)
+	return ConstructNetworkPacket(header, body)
+}
+
+
+// the address a peer says it listens on is only trusted if the connection comes from that host,
+// so a peer can't claim another host's address, peers on the same host can't be told apart
+func verifyAddress(claimed string, conn net.Conn) string {
+	address, valid := NormaliseAddress(claimed)
+	remote, isTCP := conn.RemoteAddr().(*net.TCPAddr)
+	if !valid || !isTCP {
+		return ""
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, ip := range ips {
+		if ip.IP.Equal(remote.IP) {
+			return address
+		}
+	}
+	return ""
+}
+
+
+// address is the verified address of the peer, empty if unknown
+func checkVersion(version coin.VersionMessage, address string) error {
+	if version.ProtocolVersion < MinProtocolVersion {
+		return errors.New("protocol version " + strconv.Itoa(version.ProtocolVersion) + " is too old")
+	}
+	if version.NetworkId != localVersion.NetworkId {
+		// the address in the Version message is whatever the peer claims, so it's rejected without being banned
+		return errors.New("peer is on a different network")
+	}
+	if address != "" && IsBanned(address) {
+		return errors.New("peer is banned")
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package netpack
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"pocketcoin/coin"
+)
+
+
+// ---- Inventory Gossip ----
+// nodes relay new transactions and blocks by announcing their hashes in an Inv message instead of sending them in full
+// a peer that doesn't have an item asks for it with GetData and is sent it as a Transaction or MinedBlock message
+// each peer has a set of the items it's known to have, from the items it announced or sent and the items sent to it,
+// and items are only announced to peers that aren't known to have them, so an item crosses each connection once
+// the sets are keyed by the address verified for the peer's connections, kept while it has a connection open
+// and dropped once they're all closed, peers without a verified address aren't tracked
+// requested items are remembered for a while so an item announced by several peers is only asked for once
+
+
+const InvTransaction = "tx"
+const InvBlock = "block"
+
+const maxKnownInventory = 10000  // items remembered per peer
+const maxInventoryPeers = 125  // peers tracked at once, peers past this are announced every item
+const maxInvItems = 1000  // items in one Inv or GetData message
+const getDataTimeout = 30 * time.Second  // time before an item that hasn't arrived is asked for again
+
+
+// a set of item hashes that forgets the oldest once it's full
+type inventorySet struct {
+	items map[string]bool
+	order []string
+	conns int  // open connections with the peer
+}
+
+
+var knownInventory = make(map[string]*inventorySet)  // peer address -> items the peer has
+var requestedInventory = make(map[string]time.Time)  // item hash -> when it was asked for
+var inventoryLock sync.Mutex
+
+
+func (set *inventorySet) add(hash string) {
+	if set.items[hash] {
+		return
+	}
+	if len(set.order) >= maxKnownInventory {
+		delete(set.items, set.order[0])
+		set.order = set.order[1:]
+	}
+	set.items[hash] = true
+	set.order = append(set.order, hash)
+}
+
+
+// starts tracking the items a peer has when a connection to it opens, false if too many peers are tracked
+func trackInventory(address string) bool {
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+
+	set, found := knownInventory[address]
+	if !found {
+		if len(knownInventory) >= maxInventoryPeers {
+			return false
+		}
+		set = &inventorySet{items: make(map[string]bool)}
+		knownInventory[address] = set
+	}
+	set.conns++
+	return true
+}
+
+
+// forgets the items a peer has once its last connection closes
+func untrackInventory(address string) {
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+
+	set, found := knownInventory[address]
+	if !found {
+		return
+	}
+	set.conns--
+	if set.conns <= 0 {
+		delete(knownInventory, address)
+	}
+}
+
+
+// MarkKnown records that a peer has an item, address is the address verified for a connection to the peer
+func MarkKnown(address string, hash string) {
+	address, valid := NormaliseAddress(address)
+	if !valid {
+		return
+	}
+
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+
+	if set, found := knownInventory[address]; found {
+		set.add(hash)
+	}
+}
+
+
+// PeerHas returns whether a peer is known to have an item
+func PeerHas(address string, hash string) bool {
+	address, _ = NormaliseAddress(address)
+
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+
+	set, found := knownInventory[address]
+	return found && set.items[hash]
+}
+
+
+// Announce sends an Inv for the item to each peer that isn't known to have it
+func Announce(node string, item coin.InvItem, addresses []string) {
+	packetString := inventoryPacket(node, "Inv", []coin.InvItem{item})
+	for _, address := range addresses {
+		if PeerHas(address, item.Hash) {
+			continue
+		}
+		BroadcastPacket(packetString, address)
+		MarkKnown(address, item.Hash)
+	}
+}
+
+
+// RequestInventory asks the peer that sent an Inv for the items in it that haven't been received or asked for yet
+// the items are asked for at the address verified for the connection the Inv arrived on, never the header address
+// have returns whether an item has already been received, returns how many items were asked for
+func RequestInventory(node string, peer *Conn, body string, have func(coin.InvItem) bool) int {
+	if peer.Address == "" {
+		return 0
+	}
+
+	var wanted []coin.InvItem
+	for _, item := range InventoryItems(body) {
+		MarkKnown(peer.Address, item.Hash)
+		if !have(item) && markRequested(item.Hash) {
+			wanted = append(wanted, item)
+		}
+	}
+
+	if len(wanted) > 0 {
+		BroadcastPacket(inventoryPacket(node, "GetData", wanted), peer.Address)
+	}
+	return len(wanted)
+}
+
+
+// InventoryItems reads the items in the body of an Inv or GetData message
+func InventoryItems(body string) []coin.InvItem {
+	var items []coin.InvItem
+	json.Unmarshal([]byte(body), &items)
+	if len(items) > maxInvItems {
+		items = items[:maxInvItems]
+	}
+	return items
+}
+
+
+// returns false if the item was asked for recently
+func markRequested(hash string) bool {
+	inventoryLock.Lock()
+	defer inventoryLock.Unlock()
+
+	now := time.Now()
+	if requested, found := requestedInventory[hash]; found && now.Sub(requested) < getDataTimeout {
+		return false
+	}
+
+	if len(requestedInventory) >= maxKnownInventory {
+		for itemHash, requested := range requestedInventory {
+			if now.Sub(requested) >= getDataTimeout {
+				delete(requestedInventory, itemHash)
+			}
+		}
+	}
+	requestedInventory[hash] = now
+	return true
+}
+
+
+func inventoryPacket(node string, request string, items []coin.InvItem) string {
+	itemsString, _ := json.Marshal(items)
+	reqHeader := ConstructRequestHeader(node, request)
+	packet := ConstructNetworkPacket(reqHeader, string(itemsString))
+	packetString, _ := json.Marshal(packet)
+
+	return string(packetString)
+}
@@ -0,0 +1,177 @@
+package netpack
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+
+	"pocketcoin/coin"
+)
+
+
+// ---- Message Framing ----
+// every message is sent as a frame so payloads can contain any bytes, including newlines
+//     magic     4 bytes   "PKCN"
+//     type      1 byte    MessageType of the packet
+//     length    4 bytes   big endian length of the payload
+//     checksum  4 bytes   first 4 bytes of sha256(sha256(payload))
+//     payload   the json NetworkPacket
+// frames with the wrong magic, an unknown type, a payload over MaxMessageSize or a bad checksum close the connection
+
+
+const MaxMessageSize = 8 * 1024 * 1024
+const frameHeaderSize = 13
+
+var frameMagic = []byte("PKCN")
+
+
+type MessageType uint8
+
+const (
+	MsgVersion MessageType = iota + 1
+	MsgVerAck
+	MsgReject
+	MsgTransaction
+	MsgMinedBlock
+	MsgBalance
+	MsgAccountNonce
+	MsgBlockHeight
+	MsgGetBlockByHash
+	MsgGetHeaders
+	MsgHeaders
+	MsgGetBlocks
+	MsgBlocks
+	MsgPublicKeyInCache
+	MsgUnspentOutputs
+	MsgMerkleProof
+	MsgGetPeers
+	MsgPeers
+	MsgResponse  // generic response
+	MsgInv
+	MsgGetData
+	MsgGetTransaction
+	MsgSubmitTransaction
+)
+
+
+// the Request name in the packet header of each message type
+var messageNames = map[MessageType]string{
+	MsgVersion: "Version",
+	MsgVerAck: "VerAck",
+	MsgReject: "Reject",
+	MsgTransaction: "Transaction",
+	MsgMinedBlock: "MinedBlock",
+	MsgBalance: "Balance",
+	MsgAccountNonce: "AccountNonce",
+	MsgBlockHeight: "BlockHeight",
+	MsgGetBlockByHash: "GetBlockByHash",
+	MsgGetHeaders: "GetHeaders",
+	MsgHeaders: "Headers",
+	MsgGetBlocks: "GetBlocks",
+	MsgBlocks: "Blocks",
+	MsgPublicKeyInCache: "PublicKeyInCache",
+	MsgUnspentOutputs: "UnspentOutputs",
+	MsgMerkleProof: "MerkleProof",
+	MsgGetPeers: "GetPeers",
+	MsgPeers: "Peers",
+	MsgResponse: "Response",
+	MsgInv: "Inv",
+	MsgGetData: "GetData",
+	MsgGetTransaction: "GetTransaction",
+	MsgSubmitTransaction: "SubmitTransaction",
+}
+
+
+func (msgType MessageType) String() string {
+	if name, known := messageNames[msgType]; known {
+		return name
+	}
+	return "Unknown(" + strconv.Itoa(int(msgType)) + ")"
+}
+
+
+// MessageTypeOf returns the message type of a packet header Request name
+func MessageTypeOf(request string) (MessageType, bool) {
+	for msgType, name := range messageNames {
+		if name == request {
+			return msgType, true
+		}
+	}
+	return 0, false
+}
+
+
+func frameChecksum(payload []byte) []byte {
+	firstHash := sha256.Sum256(payload)
+	secondHash := sha256.Sum256(firstHash[:])
+	return secondHash[:4]
+}
+
+
+// encodeFrame frames a serialised NetworkPacket
+func encodeFrame(packetString string) ([]byte, error) {
+	packet := coin.NetworkPacket{}
+	err := json.Unmarshal([]byte(packetString), &packet)
+	if err != nil {
+		return nil, err
+	}
+	msgType, known := MessageTypeOf(packet.Header.Request)
+	if !known {
+		return nil, errors.New("unknown message type " + packet.Header.Request)
+	}
+	if len(packetString) > MaxMessageSize {
+		return nil, errors.New(msgType.String() + " message too large")
+	}
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize + len(packetString))
+	copy(frame[0:4], frameMagic)
+	frame[4] = byte(msgType)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(packetString)))
+	copy(frame[9:13], frameChecksum([]byte(packetString)))
+
+	return append(frame, packetString...), nil
+}
+
+
+// readFrame reads one frame and returns its packet, the packet's Request has to match the frame type
+func readFrame(reader io.Reader) (coin.NetworkPacket, error) {
+	packet := coin.NetworkPacket{}
+	header := make([]byte, frameHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return packet, err
+	}
+
+	if string(header[0:4]) != string(frameMagic) {
+		return packet, errors.New("invalid message magic")
+	}
+	msgType := MessageType(header[4])
+	if _, known := messageNames[msgType]; !known {
+		return packet, errors.New("unknown message type " + msgType.String())
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > MaxMessageSize {
+		return packet, errors.New(msgType.String() + " message too large")
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return packet, err
+	}
+	if string(frameChecksum(payload)) != string(header[9:13]) {
+		return packet, errors.New(msgType.String() + " message checksum invalid")
+	}
+
+	err = json.Unmarshal(payload, &packet)
+	if err != nil {
+		return packet, err
+	}
+	if packet.Header.Request != msgType.String() {
+		return packet, errors.New("message type does not match the packet request " + packet.Header.Request)
+	}
+	return packet, nil
+}
@@ -5,11 +5,32 @@ import (
 	"fmt"
 	"pocketcoin/coin"
 	"net"
-	"bufio"
 	"encoding/json"
+	"time"
 )
 
 
+const dialTimeout = 5 * time.Second
+
+var listenAddress string
+
+
+// SetListenAddress sets the host:port included in request headers so peers can connect back to the sender
+func SetListenAddress(address string) {
+	listenAddress, _ = NormaliseAddress(address)
+}
+
+
+// Dial connects to a peers host:port address, a bare port is treated as a port on localhost
+func Dial(address string) (net.Conn, error) {
+	address, valid := NormaliseAddress(address)
+	if !valid {
+		return nil, &net.AddrError{Err: "invalid peer address", Addr: address}
+	}
+	return net.DialTimeout("tcp", address, dialTimeout)
+}
+
+
 func check(err error) {
 	if err != nil {
 		panic(err)
@@ -30,6 +51,7 @@ func ConstructRequestHeader(node string, request string) coin.RequestHeader {
 	reqHeader := coin.RequestHeader{}
 	reqHeader.Node = node
 	reqHeader.Request = request
+	reqHeader.Address = listenAddress
 
 	return reqHeader
 }
@@ -43,29 +65,80 @@ func DeserialisePacket(packetString string) coin.NetworkPacket {
 }
 
 
-func BroadcastPacket(packetString string, port string) {
-	fmt.Println("Attempting connection to node", port)
-	conn, err := net.Dial("tcp", "localhost:"+port)
+// BroadcastPacket queues the packet on the pooled connection to the address
+func BroadcastPacket(packetString string, address string) {
+	fmt.Println("Attempting connection to node", address)
+	peer, err := pooledConn(address)
 	if err == nil {
-		fmt.Fprintf(conn, packetString + "\n")
-		fmt.Println("Packet send successfully to node", port)
-		conn.Close()
+		err = peer.Send(packetString)
 	}
+	if err != nil {
+		fmt.Printf("Unable to send packet to node %s: %s\n", address, err)
+		return
+	}
+	fmt.Println("Packet send successfully to node", address)
 }
 
 
-func BroadcastDuplexPacket(packetString string, port string) (bool, coin.NetworkPacket) {
+// BroadcastDuplexPacket sends the packet to the address and waits for the response
+// a pooled connection the peer has closed fails the first attempt, so it's tried again on a new connection
+func BroadcastDuplexPacket(packetString string, address string) (bool, coin.NetworkPacket) {
 	fmt.Println("Attempting duplex connection to node...")
-	conn, err := net.Dial("tcp", "localhost:"+port)
-	if err == nil {
-		fmt.Fprintf(conn, packetString + "\n")
-		fmt.Println("Packet send successfully to node!")
+	for attempt := 0; attempt < 2; attempt++ {
+		peer, err := pooledConn(address)
+		if err != nil {
+			break
+		}
+
+		response, err := peer.Request(packetString)
+		if err == nil {
+			fmt.Println("Packet send successfully to node!")
+			return true, response
+		}
+	}
+
+	return false, coin.NetworkPacket{}
+}
 
-		recv, _ := bufio.NewReader(conn).ReadString('\n')
-		conn.Close()
-		return true, DeserialisePacket(recv)
 
-	} else {
-		return false, coin.NetworkPacket{}
+// RequestPeers asks a peer for the peers it knows and adds them to the peer table, returns how many were new
+func RequestPeers(address string, node string) int {
+	reqHeader := ConstructRequestHeader(node, "GetPeers")
+	packet := ConstructNetworkPacket(reqHeader, "")
+	packetString, _ := json.Marshal(packet)
+	success, response := BroadcastDuplexPacket(string(packetString), address)
+	if !success {
+		return 0
 	}
-}
\ No newline at end of file
+	return AddPeerAddresses(response.Body)
+}
+
+
+// AddPeerAddresses adds the peers in the body of a Peers message to the peer table, returns how many were new
+// only the first maxAddressesPerMessage are used so one message can't fill the table
+func AddPeerAddresses(body string) int {
+	var addresses []coin.PeerAddress
+	json.Unmarshal([]byte(body), &addresses)
+	if len(addresses) > maxAddressesPerMessage {
+		addresses = addresses[:maxAddressesPerMessage]
+	}
+
+	added := 0
+	for _, peer := range addresses {
+		if AddPeer(peer.Address, peer.Node) {
+			added++
+		}
+	}
+	return added
+}
+
+
+// PeersPacket builds a Peers message listing the peers in the table
+func PeersPacket(node string) string {
+	addressesString, _ := json.Marshal(PeerAddresses())
+	respHeader := ConstructRequestHeader(node, "Peers")
+	respPacket := ConstructNetworkPacket(respHeader, string(addressesString))
+	packetString, _ := json.Marshal(respPacket)
+
+	return string(packetString)
+}
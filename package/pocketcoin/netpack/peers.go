@@ -0,0 +1,330 @@
+package netpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pocketcoin/coin"
+	"pocketcoin/fileutil"
+)
+
+
+// ---- Peer Manager ----
+// peers are known by their host:port address and whether they're a node or a miner
+// the table starts with the seed peers from the network parameters file and grows as peers are learnt from
+// Peers messages and from the connections they make, once their address is verified in the handshake
+// peers that send invalid data build up a ban score, once it reaches BanThreshold they're ignored for BanDuration
+// the table is saved to a file so peers learnt in one run are remembered in the next
+// once the table is full a new peer replaces one that has never been seen or keeps failing to connect,
+// seed peers and peers that have been seen and connect fine are never replaced
+
+
+const NodePeer = "node"
+const MinerPeer = "miner"
+
+const BanThreshold = 100
+const BanDuration = 24 * time.Hour
+const maxPeers = 1000
+const maxAddressesPerMessage = 100
+
+
+type Peer struct {
+	Address string  // host:port
+	Node string  // node or miner
+	BanScore int
+	BannedUntil time.Time
+	LastSeen time.Time
+	Failures int  // failed connections since the peer was last reached
+	Seed bool `json:"-"`
+}
+
+
+var peerTable = make(map[string]*Peer)  // address -> peer
+var peerLock sync.Mutex
+var peerFilename string
+
+
+// NormaliseAddress turns a bare port into a localhost address, false if the address isn't a valid host:port
+func NormaliseAddress(address string) (string, bool) {
+	if _, err := strconv.Atoi(address); err == nil {
+		address = "localhost:" + address
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || port == "" {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+
+// LoadPeers reads the peer table from the file then adds the seed peers, the table is saved back to the same file
+func LoadPeers(filename string, seedNodes []string, seedMiners []string) {
+	peerLock.Lock()
+	peerFilename = filename
+	peerTable = make(map[string]*Peer)
+
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		var peers []*Peer
+		json.Unmarshal(data, &peers)
+		for _, peer := range peers {
+			if address, valid := NormaliseAddress(peer.Address); valid && validPeerType(peer.Node) {
+				peer.Address = address
+				peerTable[address] = peer
+			}
+		}
+	}
+	peerLock.Unlock()
+
+	for _, address := range seedNodes {
+		addPeer(address, NodePeer, true)
+	}
+	for _, address := range seedMiners {
+		addPeer(address, MinerPeer, true)
+	}
+}
+
+
+func validPeerType(node string) bool {
+	return node == NodePeer || node == MinerPeer
+}
+
+
+// AddPeer adds a peer to the table, returns true if the peer wasn't already known
+func AddPeer(address string, node string) bool {
+	return addPeer(address, node, false)
+}
+
+
+func addPeer(address string, node string, seed bool) bool {
+	address, valid := NormaliseAddress(address)
+	if !valid || !validPeerType(node) || address == listenAddress {
+		return false
+	}
+
+	peerLock.Lock()
+	defer peerLock.Unlock()
+
+	if peer, known := peerTable[address]; known {
+		peer.Seed = peer.Seed || seed
+		return false
+	}
+	if len(peerTable) >= maxPeers && !evictPeer() {
+		return false
+	}
+	peerTable[address] = &Peer{Address: address, Node: node, Seed: seed}
+	return true
+}
+
+
+// evictPeer removes the peer that's least likely to be reachable to make room for a new one,
+// the one with the most failed connections, then one that's never been seen, then the one seen longest ago,
+// false if every peer is a seed, banned or seen without failing since, peerLock must be held
+func evictPeer() bool {
+	var worst *Peer
+	for _, peer := range peerTable {
+		if peer.Seed || peer.banned() || !peer.LastSeen.IsZero() && peer.Failures == 0 {
+			continue
+		}
+		if worst == nil || peer.evictBefore(worst) {
+			worst = peer
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(peerTable, worst.Address)
+	return true
+}
+
+
+func (peer *Peer) evictBefore(other *Peer) bool {
+	if peer.Failures != other.Failures {
+		return peer.Failures > other.Failures
+	}
+	if !peer.LastSeen.Equal(other.LastSeen) {
+		return peer.LastSeen.Before(other.LastSeen)
+	}
+	return peer.Address < other.Address
+}
+
+
+// PeerSeen records that a packet was received from the peer, unknown peers are added to the table
+func PeerSeen(address string, node string) {
+	added := AddPeer(address, node)
+	address, _ = NormaliseAddress(address)
+
+	peerLock.Lock()
+	if peer, known := peerTable[address]; known {
+		peer.LastSeen = time.Now()
+		peer.Failures = 0
+	}
+	peerLock.Unlock()
+
+	if added {
+		SavePeers()
+	}
+}
+
+
+// peerConnected records a successful connection to a peer in the table, unknown addresses are ignored
+func peerConnected(address string) {
+	peerLock.Lock()
+	if peer, known := peerTable[address]; known {
+		peer.LastSeen = time.Now()
+		peer.Failures = 0
+	}
+	peerLock.Unlock()
+}
+
+
+// peerFailed records a failed connection to a peer in the table so it's replaced first once the table is full
+func peerFailed(address string) {
+	peerLock.Lock()
+	if peer, known := peerTable[address]; known {
+		peer.Failures++
+	}
+	peerLock.Unlock()
+}
+
+
+// Peers returns the addresses of the peers of the given type that aren't banned, most recently seen first
+func Peers(node string) []string {
+	peerLock.Lock()
+	defer peerLock.Unlock()
+
+	var peers []*Peer
+	for _, peer := range peerTable {
+		if peer.Node == node && !peer.banned() {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if !peers[i].LastSeen.Equal(peers[j].LastSeen) {
+			return peers[i].LastSeen.After(peers[j].LastSeen)
+		}
+		return peers[i].Address < peers[j].Address
+	})
+
+	addresses := make([]string, len(peers))
+	for i, peer := range peers {
+		addresses[i] = peer.Address
+	}
+	return addresses
+}
+
+
+// PeerAddresses returns every peer that isn't banned, sent in response to GetPeers
+func PeerAddresses() []coin.PeerAddress {
+	var addresses []coin.PeerAddress
+	for _, node := range []string{NodePeer, MinerPeer} {
+		for _, address := range Peers(node) {
+			addresses = append(addresses, coin.PeerAddress{Address: address, Node: node})
+		}
+	}
+	return addresses
+}
+
+
+func (peer *Peer) banned() bool {
+	return time.Now().Before(peer.BannedUntil)
+}
+
+
+func IsBanned(address string) bool {
+	address, _ = NormaliseAddress(address)
+
+	peerLock.Lock()
+	defer peerLock.Unlock()
+
+	peer, known := peerTable[address]
+	return known && peer.banned()
+}
+
+
+// Misbehaving adds to the peers ban score, the peer is banned once the score reaches BanThreshold
+func Misbehaving(address string, score int, reason string) {
+	address, valid := NormaliseAddress(address)
+	if !valid {
+		return
+	}
+
+	peerLock.Lock()
+	peer, known := peerTable[address]
+	if !known {
+		peerLock.Unlock()
+		return
+	}
+
+	peer.BanScore += score
+	banned := peer.BanScore >= BanThreshold
+	if banned {
+		peer.BanScore = 0
+		peer.BannedUntil = time.Now().Add(BanDuration)
+	}
+	peerLock.Unlock()
+
+	if banned {
+		fmt.Printf("Peer %s banned: %s\n", address, reason)
+		SavePeers()
+	}
+}
+
+
+// Misbehaving adds to the ban score of the peer on the other end of the connection
+// the score goes to the address verified in the handshake, never one the peer claims in a packet header,
+// and the connection is closed once the address is banned, a peer without a verified address
+// is scored per connection and disconnected once it reaches BanThreshold
+func (peer *Conn) Misbehaving(score int, reason string) {
+	if peer.Address != "" {
+		Misbehaving(peer.Address, score, reason)
+		if IsBanned(peer.Address) {
+			peer.Close()
+		}
+		return
+	}
+
+	peerLock.Lock()
+	peer.banScore += score
+	disconnect := peer.banScore >= BanThreshold
+	peerLock.Unlock()
+
+	if disconnect {
+		fmt.Printf("Peer %s disconnected: %s\n", peer.RemoteAddr(), reason)
+		peer.Close()
+	}
+}
+
+
+// SavePeers writes the peer table to the file it was loaded from
+func SavePeers() error {
+	peerLock.Lock()
+	defer peerLock.Unlock()
+
+	if peerFilename == "" {
+		return nil
+	}
+
+	peers := make([]*Peer, 0, len(peerTable))
+	for _, peer := range peerTable {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+
+	data, err := json.MarshalIndent(peers, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// a crash leaves either the old table or the new one, never a partly written one
+	return fileutil.AtomicWriteFile(peerFilename, data, 0644)
+}
@@ -0,0 +1,3 @@
+module pgpcache
+
+go 1.14
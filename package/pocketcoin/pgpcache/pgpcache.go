@@ -0,0 +1,120 @@
+package pgpcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"pocketcoin/blockchain"
+	"pocketcoin/fileutil"
+)
+
+
+// ---- PGP Public Key Cache ----
+// wallets only include their pgp public key in their first transaction, the node keeps the keys it has seen
+// in a cache file so later transactions can be checked without searching the blockchain for the key
+// the cache is shared by every connection goroutine so each method takes the cache's lock
+// keys from pending transactions are lost with the transaction pool when the node stops, so the cache is rebuilt
+// from the main chain when the node starts and whenever chaintool removes blocks
+
+
+const DefaultFilename = "NodeCache/pgpCache.txt"
+
+
+type Entry struct {
+	WalletAddress string
+	PublicKeyPem string
+}
+
+
+type Cache struct {
+	lock sync.Mutex
+	filename string
+	entries []Entry
+}
+
+
+// Load reads the cache file, a missing or unreadable file gives an empty cache
+func Load(filename string) *Cache {
+	cache := &Cache{filename: filename}
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		json.Unmarshal(data, &cache.entries)
+	}
+	return cache
+}
+
+
+// Get returns the cached public key of a wallet address
+func (cache *Cache) Get(walletAddress string) (string, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.get(walletAddress)
+}
+
+
+func (cache *Cache) get(walletAddress string) (string, bool) {
+	for _, entry := range cache.entries {
+		if entry.WalletAddress == walletAddress {
+			return entry.PublicKeyPem, true
+		}
+	}
+	return "", false
+}
+
+
+// Add caches a public key that has already been checked against the wallet address, addresses already cached are skipped
+func (cache *Cache) Add(walletAddress string, publicKeyPem string) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if _, found := cache.get(walletAddress); found {
+		return nil
+	}
+	cache.entries = append(cache.entries, Entry{walletAddress, publicKeyPem})
+	return cache.save()
+}
+
+
+func (cache *Cache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.entries)
+}
+
+
+// Rebuild replaces the cache with the public keys on the main chain, the chain state has to be loaded first
+func (cache *Cache) Rebuild() error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	publicKeys := blockchain.PublicKeys()
+	cache.entries = make([]Entry, 0, len(publicKeys))
+	for address, publicKeyPem := range publicKeys {
+		cache.entries = append(cache.entries, Entry{address, publicKeyPem})
+	}
+	sort.Slice(cache.entries, func(i, j int) bool {
+		return cache.entries[i].WalletAddress < cache.entries[j].WalletAddress
+	})
+
+	return cache.save()
+}
+
+
+// called with the cache's lock held
+func (cache *Cache) save() error {
+	data, err := json.Marshal(cache.entries)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(cache.filename), 0755)
+	if err != nil {
+		return err
+	}
+	return fileutil.AtomicWriteFile(cache.filename, data, 0644)
+}
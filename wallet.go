@@ -7,9 +7,9 @@ import (
 	"os"
 	"bufio"
 	"strings"
-	"strconv"
 	"errors"
 	"time"
+	"strconv"
 
 	"pocketcoin/coin"
 	"pocketcoin/pgp"
@@ -18,12 +18,12 @@ import (
 
     "crypto/sha256"
     "encoding/hex"
+    "encoding/json"
     b64 "encoding/base64"
 )
 
 
 var walletFilepath string
-var nodeList = []string{"5555", "5556", "5557", "5558", "5559"}
 
 
 func check(err error) {
@@ -37,14 +37,21 @@ func main() {
 	walletFilepathPtr := flag.String("f", "", "folder for wallet")
 	balancePtr := flag.Bool("b", false, "display wallet balance")
 	transactionPtr := flag.Bool("t", false, "Send a transaction")
+	utxoTransactionPtr := flag.Bool("u", false, "Send a UTXO transaction")
 	addrPtr := flag.Bool("w", false, "show wallet address")
 	newAddrPtr := flag.Bool("n", false, "create a new wallet address")
+	verifyPtr := flag.Bool("v", false, "verify a transaction is included in a block")
+	txIdPtr := flag.String("tx", "", "look up a transaction by its ID")
+	paramsPtr := flag.String("params", blockchain.DefaultParamsFile, "network parameters file")
 	flag.Parse()
 
 	balanceFlag := *balancePtr
 	addrFlag := *addrPtr
 	transactionFlag := *transactionPtr
+	utxoTransactionFlag := *utxoTransactionPtr
 	newAddrFlag := *newAddrPtr
+	verifyFlag := *verifyPtr
+	txId := strip(*txIdPtr)
 	walletFilepath = *walletFilepathPtr
 
 	if walletFilepath == "" {
@@ -53,10 +60,24 @@ func main() {
 		return
 	}
 
+	params, err := blockchain.LoadNetworkParams(*paramsPtr)
+	if err != nil {
+		fmt.Println("Unable to load network parameters:", err)
+		return
+	}
+	netpack.LoadPeers("", params.SeedNodes, nil)
+	netpack.SetLocalVersion(params.GenesisHash, "pocketcoin-wallet", 0, nil)
+	defer netpack.CloseConnections()  // queued transactions are written before exiting
+
 	if balanceFlag {
 		walletAddress := loadWalletAddress()
 		balance := requestWalletBalance(walletAddress)
-		fmt.Println("Wallet balance:", balance)
+		if balance < 0 {
+			fmt.Println("Unable to get the wallet balance from the network")
+			return
+		}
+		fmt.Println("Wallet balance:", coin.FormatAmount(balance))
+		fmt.Println("Unspent outputs:", coin.FormatAmount(sumUnspentOutputs(requestUnspentOutputs(walletAddress))))
 	}
 
 	if addrFlag {
@@ -72,16 +93,21 @@ func main() {
 		
 		// get the amount of coins to send to the address
 		fmt.Print("Amount to send (up to 6 decimal points): ")
-		amount := getAmountToSend()
+		amount, err := getAmountToSend()
+		check(err)
+
+		// higher fees get the transaction into a block sooner
+		fmt.Print("Fee to pay the miner (up to 6 decimal points): ")
+		fee, err := getFeeToPay()
+		check(err)
 		
 		// get the sender address from memory
 		fromAddr := loadWalletAddress()
 
-		fmt.Printf("\nSending %f to %s from %s\n", amount, toAddr, fromAddr)
+		fmt.Printf("\nSending %s to %s from %s with a fee of %s\n", coin.FormatAmount(amount), toAddr, fromAddr, coin.FormatAmount(fee))
 
-		transactionPacket := constructTransactionPacket(toAddr, fromAddr, amount)
-		broadcastTransactionToNetwork(transactionPacket)
-		fmt.Println("\nTransaction successfully sent!")
+		transactionPacket := constructTransactionPacket(toAddr, fromAddr, amount, fee)
+		printBroadcastResult(broadcastTransactionToNetwork(transactionPacket))
 
 
 		// connect to a node in the network
@@ -90,6 +116,63 @@ func main() {
 		// handle any errors returned back from the node
 	}
 
+	if utxoTransactionFlag {
+		fmt.Print("Wallet Address to send coins to: ")
+		toAddr, err := getSendAddress()
+		check(err)
+
+		fmt.Print("Amount to send (up to 6 decimal points): ")
+		amount, err := getAmountToSend()
+		check(err)
+
+		fmt.Print("Fee to pay the miner (up to 6 decimal points): ")
+		fee, err := getFeeToPay()
+		check(err)
+
+		fromAddr := loadWalletAddress()
+
+		fmt.Printf("\nSending %s to %s from %s using unspent outputs with a fee of %s\n", coin.FormatAmount(amount), toAddr, fromAddr, coin.FormatAmount(fee))
+
+		transactionPacket := constructUTXOTransactionPacket(toAddr, fromAddr, amount, fee)
+		printBroadcastResult(broadcastTransactionToNetwork(transactionPacket))
+	}
+
+	if verifyFlag {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Block ID containing the transaction: ")
+		blockId, err := reader.ReadString('\n')
+		check(err)
+		fmt.Print("Transaction ID: ")
+		txHash, err := reader.ReadString('\n')
+		check(err)
+
+		blockId, txHash = strip(blockId), strip(txHash)
+		proof, found := requestMerkleProof(blockId, txHash)
+
+		// the proof comes from the node being checked, so it has to be for the transaction and block asked about
+		// and the header has to carry its proof of work
+		if !found {
+			fmt.Println("Transaction not found in block")
+		} else if proof.TxHash != txHash || proof.Header.BlockId != blockId {
+			fmt.Println("Merkle proof returned by the node is for a different transaction or block!")
+		} else if !blockchain.HashMeetsTarget(blockchain.HeaderHash(proof.Header), proof.Header.TargetBits) {
+			fmt.Println("Block header returned by the node does not meet its target!")
+		} else if blockchain.VerifyMerkleProof(proof) {
+			fmt.Println("Transaction verified! Merkle root:", proof.Header.MerkleRoot)
+		} else {
+			fmt.Println("Merkle proof returned by the node is invalid!")
+		}
+	}
+
+	if txId != "" {
+		status, found := requestTransaction(txId)
+		if !found {
+			fmt.Println("Transaction", txId, "not found on the network")
+		} else {
+			printTransactionStatus(status)
+		}
+	}
+
 	if newAddrFlag {
 		fmt.Print("Creating a new wallet will delete the previously stored wallet, are you sure? (y/n): ")
 		reader := bufio.NewReader(os.Stdin)
@@ -172,13 +255,39 @@ func getSendAddress() (string, error) {
 }
 
 
-func getAmountToSend() float64 {
+func getAmountToSend() (int64, error) {
+	amount, err := readAmount()
+	if err != nil {
+		return 0, err
+	}
+	if amount <= 0 {
+		return 0, errors.New("amount must be more than 0")
+	}
+
+	return amount, nil
+}
+
+
+// a fee of 0 is allowed, the transaction just waits longer for a block
+func getFeeToPay() (int64, error) {
+	fee, err := readAmount()
+	if err != nil {
+		return 0, err
+	}
+	if fee < 0 {
+		return 0, errors.New("fee can't be negative")
+	}
+
+	return fee, nil
+}
+
+
+func readAmount() (int64, error) {
 	reader := bufio.NewReader(os.Stdin)
 	amountString, err := reader.ReadString('\n')
-	amount, err := strconv.ParseFloat(strip(amountString), 64)
 	check(err)
 
-	return amount
+	return coin.ParseAmount(strip(amountString))
 }
 
 
@@ -199,7 +308,7 @@ func addressIsValid(addr string) bool {
 }
 
 
-func constructTransactionPacket(toAddr string, fromAddr string, amount float64) coin.Transaction {
+func constructTransactionPacket(toAddr string, fromAddr string, amount int64, fee int64) coin.Transaction {
 	var publicKey string
 	if requestPublicKeyCacheExistance(fromAddr) {
 		publicKey = ""
@@ -213,6 +322,8 @@ func constructTransactionPacket(toAddr string, fromAddr string, amount float64)
 	t_packet.ToAddress = toAddr
 	t_packet.FromAddress = fromAddr
 	t_packet.Amount = amount
+	t_packet.Fee = fee
+	t_packet.Nonce = requestAccountNonce(fromAddr)
 	t_packet.Timestamp = time.Now().String()
 	t_packet.PublicKey = publicKey
 	t_packet.Signature = signTransaction(t_packet, loadPrivateKeyPem())
@@ -221,8 +332,65 @@ func constructTransactionPacket(toAddr string, fromAddr string, amount float64)
 }
 
 
+// spends the wallets unspent outputs first, whatever is left is drawn from the wallets account balance
+func constructUTXOTransactionPacket(toAddr string, fromAddr string, amount int64, fee int64) coin.Transaction {
+	var publicKey string
+	if requestPublicKeyCacheExistance(fromAddr) {
+		publicKey = ""
+	} else {
+		publicKey = loadPublicKeyPem()
+	}
+
+	t_packet := coin.Transaction{}
+	t_packet.FromAddress = fromAddr
+	t_packet.Timestamp = time.Now().String()
+	t_packet.PublicKey = publicKey
+	t_packet.Fee = fee
+
+	// the fee is paid out of the spent outputs along with the amount
+	totalSpend := amount + fee
+	inputTotal := int64(0)
+	for _, unspent := range requestUnspentOutputs(fromAddr) {
+		if inputTotal >= totalSpend {
+			break
+		}
+		input := coin.TxInput{}
+		input.PrevTxId = unspent.TxId
+		input.OutputIndex = unspent.OutputIndex
+		t_packet.Inputs = append(t_packet.Inputs, input)
+		inputTotal += unspent.Output.Amount
+	}
+
+	payment := coin.TxOutput{}
+	payment.Amount = amount
+	payment.Address = toAddr
+	t_packet.Outputs = append(t_packet.Outputs, payment)
+
+	if inputTotal > totalSpend {
+		change := coin.TxOutput{}
+		change.Amount = inputTotal - totalSpend
+		change.Address = fromAddr
+		t_packet.Outputs = append(t_packet.Outputs, change)
+	} else if inputTotal < totalSpend {
+		t_packet.Amount = totalSpend - inputTotal
+		t_packet.Nonce = requestAccountNonce(fromAddr)
+	}
+
+	// the wallet owns every input so one signature covers them all
+	signature := signTransaction(t_packet, loadPrivateKeyPem())
+	for i := range t_packet.Inputs {
+		t_packet.Inputs[i].Signature = signature
+	}
+	if t_packet.Amount > 0 {
+		t_packet.Signature = signature
+	}
+
+	return t_packet
+}
+
+
 func signTransaction(tx coin.Transaction, privateKeyPem string) string {
-	txString, _ := blockchain.Serialise(tx)
+	txString := blockchain.SigningString(tx)
 	privateKey, _ := pgp.ParsePrivateKeyFromPemStr(privateKeyPem)
 
 	txSignature := pgp.SignMessage(txString, privateKey)
@@ -232,30 +400,60 @@ func signTransaction(tx coin.Transaction, privateKeyPem string) string {
 }
 
 
-func broadcastTransactionToNetwork(tx coin.Transaction) {
-	reqHeader := netpack.ConstructRequestHeader("wallet", "Transaction")
+// sends the transaction to every node and returns its ID
+// sends the transaction to every known node, returns its id if at least one node added it to its pool
+// otherwise the reasons the nodes gave are returned
+func broadcastTransactionToNetwork(tx coin.Transaction) (string, []string) {
+	reqHeader := netpack.ConstructRequestHeader("wallet", "SubmitTransaction")
 	transactionString, err := blockchain.Serialise(tx)
 	check(err)
 	packet := netpack.ConstructNetworkPacket(reqHeader, transactionString)
 	packetString, _ := blockchain.Serialise(packet)
 
-	for _, port := range nodeList {
-		netpack.BroadcastPacket(packetString, port)
+	accepted := false
+	var rejections []string
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
+		if !success {
+			rejections = append(rejections, address + ": no response")
+		} else if response.Body != "" {
+			rejections = append(rejections, address + ": " + response.Body)
+		} else {
+			accepted = true
+		}
 	}
+
+	if !accepted {
+		return "", rejections
+	}
+	return coin.TransactionId(tx), nil
+}
+
+
+func printBroadcastResult(sentTxId string, rejections []string) {
+	if sentTxId == "" {
+		fmt.Println("\nTransaction was not accepted by any node!")
+		for _, rejection := range rejections {
+			fmt.Println("    " + rejection)
+		}
+		return
+	}
+	fmt.Println("\nTransaction successfully sent!")
+	fmt.Println("Transaction ID:", sentTxId)
 }
 
 
-func requestWalletBalance(walletAddr string) float64 {
+func requestWalletBalance(walletAddr string) int64 {
 	reqHeader := netpack.ConstructRequestHeader("wallet", "Balance")
 	packet := netpack.ConstructNetworkPacket(reqHeader, walletAddr)
 	packetString, _ := blockchain.Serialise(packet)
-	balance := -1.0
+	balance := int64(-1)
 
-	for _, port := range nodeList {
-		success, response := netpack.BroadcastDuplexPacket(packetString, port)
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
 
 		if success {
-			balance, _ = strconv.ParseFloat(response.Body, 64)
+			balance, _ = coin.ParseAmount(response.Body)
 			break
 		}
 	}
@@ -264,14 +462,41 @@ func requestWalletBalance(walletAddr string) float64 {
 }
 
 
+func requestUnspentOutputs(walletAddr string) []coin.UnspentOutput {
+	reqHeader := netpack.ConstructRequestHeader("wallet", "UnspentOutputs")
+	packet := netpack.ConstructNetworkPacket(reqHeader, walletAddr)
+	packetString, _ := blockchain.Serialise(packet)
+	unspentOutputs := []coin.UnspentOutput{}
+
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
+		if success {
+			json.Unmarshal([]byte(response.Body), &unspentOutputs)
+			break
+		}
+	}
+
+	return unspentOutputs
+}
+
+
+func sumUnspentOutputs(unspentOutputs []coin.UnspentOutput) int64 {
+	total := int64(0)
+	for _, unspent := range unspentOutputs {
+		total += unspent.Output.Amount
+	}
+	return total
+}
+
+
 func requestPublicKeyCacheExistance(walletAddress string) bool {
 	reqHeader := netpack.ConstructRequestHeader("wallet", "PublicKeyInCache")
 	packet := netpack.ConstructNetworkPacket(reqHeader, walletAddress)
 	packetString, _ := blockchain.Serialise(packet)
 	exists := false
 
-	for _, port := range nodeList {
-		success, response := netpack.BroadcastDuplexPacket(packetString, port)
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
 		if success {
 			if response.Body == "true" {
 				exists = true
@@ -281,4 +506,86 @@ func requestPublicKeyCacheExistance(walletAddress string) bool {
 	}
 	
 	return exists
-}
\ No newline at end of file
+}
+
+
+// gets the nonce the wallets next account transaction needs from the first node that responds
+func requestAccountNonce(walletAddress string) int {
+	reqHeader := netpack.ConstructRequestHeader("wallet", "AccountNonce")
+	packet := netpack.ConstructNetworkPacket(reqHeader, walletAddress)
+	packetString, _ := blockchain.Serialise(packet)
+
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
+		if success {
+			nonce, _ := strconv.Atoi(response.Body)
+			return nonce
+		}
+	}
+
+	return 0
+}
+
+
+func requestMerkleProof(blockId string, txHash string) (coin.MerkleProof, bool) {
+	proofRequest := coin.MerkleProofRequest{}
+	proofRequest.BlockId = blockId
+	proofRequest.TxHash = txHash
+	proofRequestString, _ := blockchain.Serialise(proofRequest)
+
+	reqHeader := netpack.ConstructRequestHeader("wallet", "MerkleProof")
+	packet := netpack.ConstructNetworkPacket(reqHeader, proofRequestString)
+	packetString, _ := blockchain.Serialise(packet)
+	proof := coin.MerkleProof{}
+
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
+		if success {
+			if response.Body == "" {
+				return proof, false
+			}
+			json.Unmarshal([]byte(response.Body), &proof)
+			return proof, true
+		}
+	}
+
+	return proof, false
+}
+
+
+// asks the nodes for the transaction until one of them has it
+func requestTransaction(txId string) (coin.TransactionStatus, bool) {
+	reqHeader := netpack.ConstructRequestHeader("wallet", "GetTransaction")
+	packet := netpack.ConstructNetworkPacket(reqHeader, txId)
+	packetString, _ := blockchain.Serialise(packet)
+	status := coin.TransactionStatus{}
+
+	for _, address := range netpack.Peers(netpack.NodePeer) {
+		success, response := netpack.BroadcastDuplexPacket(packetString, address)
+		if success && response.Body != "" {
+			json.Unmarshal([]byte(response.Body), &status)
+			return status, true
+		}
+	}
+
+	return status, false
+}
+
+
+func printTransactionStatus(status coin.TransactionStatus) {
+	tx := status.Transaction
+	fmt.Println("Transaction ID:", status.TxId)
+	if status.Pending {
+		fmt.Println("Status: pending, waiting to be mined")
+	} else {
+		fmt.Printf("Status: confirmed in block %d (%s) with %d confirmations\n", status.BlockHeight, status.BlockHash, status.Confirmations)
+	}
+	fmt.Println("From:", tx.FromAddress)
+	if tx.ToAddress != "" {
+		fmt.Println("To:", tx.ToAddress, "amount", coin.FormatAmount(tx.Amount))
+	}
+	for _, output := range tx.Outputs {
+		fmt.Println("To:", output.Address, "amount", coin.FormatAmount(output.Amount))
+	}
+	fmt.Println("Fee:", coin.FormatAmount(tx.Fee))
+}